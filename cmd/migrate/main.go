@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"strava-wx/pkg/database"
+)
+
+// migrate copies tokens and settings from the legacy per-type tables into the
+// single table named by TABLE_NAME.
+func main() {
+	var tables database.LegacyTables
+	flag.StringVar(&tables.AccessTokens, "access-tokens", "AccessTokens", "legacy access token table, or empty to skip")
+	flag.StringVar(&tables.RefreshTokens, "refresh-tokens", "RefreshTokens", "legacy refresh token table, or empty to skip")
+	flag.StringVar(&tables.AthleteSettings, "athlete-settings", "AthleteSettings", "legacy athlete settings table, or empty to skip")
+	flag.Parse()
+
+	ctx := context.Background()
+	client, err := database.CreateClient(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	count, err := client.MigrateLegacyTables(ctx, tables)
+	if err != nil {
+		log.Fatalf("Copied %d items before error: %s", count, err.Error())
+	}
+	log.Printf("Copied %d items.", count)
+}
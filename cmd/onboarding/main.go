@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"strava-wx/pkg/database"
+	"strava-wx/pkg/web/strava"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+const stateCookie = "strava_wx_state"
+
+var stravaClient = http.DefaultClient
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>strava-wx</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Link}}<p><a href="{{.Link}}">Try again</a></p>{{end}}
+</body>
+</html>
+`))
+
+func renderPage(statusCode int, title, message string) events.LambdaFunctionURLResponse {
+	return renderPageWithLink(statusCode, title, message, "")
+}
+
+func renderPageWithLink(statusCode int, title, message, link string) (resp events.LambdaFunctionURLResponse) {
+	var sb strings.Builder
+	if err := page.Execute(&sb, map[string]string{"Title": title, "Message": message, "Link": link}); err != nil {
+		log.Println("ERROR:", err)
+		resp.StatusCode = http.StatusInternalServerError
+		return resp
+	}
+
+	resp.StatusCode = statusCode
+	resp.Headers = map[string]string{"Content-Type": "text/html; charset=utf-8"}
+	resp.Body = sb.String()
+	return resp
+}
+
+func getRedirectUri(req events.LambdaFunctionURLRequest) string {
+	return "https://" + req.RequestContext.DomainName + "/callback"
+}
+
+func getStateCookie(req events.LambdaFunctionURLRequest) string {
+	for _, line := range req.Cookies {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+		for _, cookie := range cookies {
+			if cookie.Name == stateCookie {
+				return cookie.Value
+			}
+		}
+	}
+	return ""
+}
+
+func createStateCookie(state string, maxAge int) string {
+	cookie := http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
+
+func handleAuthorize(req events.LambdaFunctionURLRequest) (resp events.LambdaFunctionURLResponse, err error) {
+	log.Println("Received authorization request. Generating state...")
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	log.Println("State generated. Redirecting to Strava...")
+	resp.StatusCode = http.StatusFound
+	resp.Headers = map[string]string{"Location": strava.GetAuthorizeUrl(getRedirectUri(req), strava.Scope, state)}
+	resp.Cookies = []string{createStateCookie(state, 600)}
+	return resp, nil
+}
+
+func handleCallback(client database.TokenStore, ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	log.Println("Received callback. Verifying state...")
+	state := req.QueryStringParameters["state"]
+	cookie := getStateCookie(req)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		log.Println("State verification failed.")
+		return renderPage(http.StatusBadRequest, "Authorization expired", "Please start over from the beginning."), nil
+	}
+
+	log.Println("State verified. Checking if authorization was granted...")
+	if e := req.QueryStringParameters["error"]; e != "" {
+		log.Println("Authorization was not granted:", e)
+		return renderPage(http.StatusForbidden, "Authorization denied", "strava-wx needs access to your activities to add the weather to them."), nil
+	}
+
+	log.Println("Authorization granted. Checking scopes...")
+	grantedScope := req.QueryStringParameters["scope"]
+	if !strava.HasRequiredScopes(grantedScope) {
+		log.Println("Required scopes not granted:", grantedScope)
+		return renderPageWithLink(http.StatusForbidden, "More access needed",
+			"strava-wx needs to view all of your activities, including private ones, and to edit them so it can add the weather. Please authorize again and leave every box checked.", "/"), nil
+	}
+
+	log.Println("Scopes checked. Exchanging code for tokens...")
+	tokens, err := strava.ExchangeToken(stravaClient, req.QueryStringParameters["code"])
+	if strava.IsPermanent(err) {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusBadRequest, "Authorization expired", "Please start over from the beginning."), nil
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusBadGateway, "Something went wrong", "Strava could not be reached. Please try again later."), nil
+	}
+	if tokens.Athlete.Id == 0 || tokens.Refresh_token == "" {
+		log.Println("Token exchange failed.")
+		return renderPage(http.StatusBadRequest, "Authorization expired", "Please start over from the beginning."), nil
+	}
+
+	log.Println("Tokens retrieved. Saving access token...")
+	accessToken := database.AccessToken{AthleteId: tokens.Athlete.Id, Code: tokens.Access_token, ExpiresAt: tokens.Expires_at, Scope: grantedScope}
+	if err = client.UpdateAccessToken(ctx, accessToken); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Access token saved. Saving refresh token...")
+	refreshToken := database.RefreshToken{AthleteId: tokens.Athlete.Id, Code: tokens.Refresh_token}
+	if err = client.UpdateRefreshToken(ctx, refreshToken); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Refresh token saved. Responding OK...")
+	resp := renderPage(http.StatusOK, "You're all set", "The weather will be added to your new Strava activities.")
+	resp.Cookies = []string{createStateCookie("", -1)}
+	return resp, nil
+}
+
+func handleRequest(client database.TokenStore, ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	if req.RequestContext.HTTP.Method != "GET" {
+		return events.LambdaFunctionURLResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+	}
+
+	switch req.RawPath {
+	case "", "/":
+		return handleAuthorize(req)
+	case "/callback":
+		return handleCallback(client, ctx, req)
+	}
+	return events.LambdaFunctionURLResponse{StatusCode: http.StatusNotFound}, nil
+}
+
+func onboardingHandler(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	log.Println("Creating DynamoDB client...")
+	client, err := database.CreateClient(ctx)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Client created.")
+	return handleRequest(client, ctx, req)
+}
+
+func main() {
+	lambda.Start(onboardingHandler)
+}
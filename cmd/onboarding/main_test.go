@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"strava-wx/pkg/database"
+	"strava-wx/pkg/web/strava"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const athleteId = 1234
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func createRequest(method, path, cookie string, query map[string]string) events.LambdaFunctionURLRequest {
+	req := events.LambdaFunctionURLRequest{RawPath: path, QueryStringParameters: query}
+	req.RequestContext.HTTP.Method = method
+	req.RequestContext.DomainName = "onboarding.example.com"
+	if cookie != "" {
+		req.Cookies = []string{stateCookie + "=" + cookie}
+	}
+	return req
+}
+
+func TestHandleRequest(t *testing.T) {
+	const grantedScope = "read,activity:read_all,activity:write"
+
+	tests := map[string]struct {
+		req         events.LambdaFunctionURLRequest
+		tokenStatus int
+		statusCode  int
+		body        string
+		exchanges   int
+		saved       bool
+	}{
+		"authorize": {
+			req:        createRequest("GET", "/", "", nil),
+			statusCode: http.StatusFound,
+		},
+		"missing state": {
+			req:        createRequest("GET", "/callback", "state", map[string]string{"code": "code", "scope": grantedScope}),
+			statusCode: http.StatusBadRequest,
+			body:       "Authorization expired",
+		},
+		"state mismatch": {
+			req:        createRequest("GET", "/callback", "state", map[string]string{"state": "other", "code": "code", "scope": grantedScope}),
+			statusCode: http.StatusBadRequest,
+			body:       "Authorization expired",
+		},
+		"missing cookie": {
+			req:        createRequest("GET", "/callback", "", map[string]string{"state": "state", "code": "code", "scope": grantedScope}),
+			statusCode: http.StatusBadRequest,
+			body:       "Authorization expired",
+		},
+		"denied": {
+			req:        createRequest("GET", "/callback", "state", map[string]string{"state": "state", "error": "access_denied"}),
+			statusCode: http.StatusForbidden,
+			body:       "Authorization denied",
+		},
+		"missing scopes": {
+			req:        createRequest("GET", "/callback", "state", map[string]string{"state": "state", "code": "code", "scope": "read,activity:read_all"}),
+			statusCode: http.StatusForbidden,
+			body:       "More access needed",
+		},
+		"invalid code": {
+			req:         createRequest("GET", "/callback", "state", map[string]string{"state": "state", "code": "code", "scope": grantedScope}),
+			tokenStatus: http.StatusBadRequest,
+			statusCode:  http.StatusBadRequest,
+			body:        "Authorization expired",
+			exchanges:   1,
+		},
+		"strava unavailable": {
+			req:         createRequest("GET", "/callback", "state", map[string]string{"state": "state", "code": "code", "scope": grantedScope}),
+			tokenStatus: http.StatusServiceUnavailable,
+			statusCode:  http.StatusBadGateway,
+			body:        "Strava could not be reached",
+			exchanges:   1,
+		},
+		"authorized": {
+			req:        createRequest("GET", "/callback", "state", map[string]string{"state": "state", "code": "code", "scope": grantedScope}),
+			statusCode: http.StatusOK,
+			body:       "You&#39;re all set",
+			exchanges:  1,
+			saved:      true,
+		},
+		"wrong method": {
+			req:        createRequest("POST", "/callback", "state", nil),
+			statusCode: http.StatusMethodNotAllowed,
+		},
+		"unknown path": {
+			req:        createRequest("GET", "/other", "", nil),
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			exchanges := 0
+			oldStravaClient := stravaClient
+			stravaClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method != "POST" || req.URL.Path != "/api/v3/oauth/token" || req.URL.Query().Get("code") != "code" {
+					t.Errorf("unexpected request %s %s", req.Method, req.URL)
+				}
+				exchanges++
+
+				status, body := http.StatusOK, `{"access_token":"access","expires_at":4102444800,"refresh_token":"refresh","athlete":{"id":1234}}`
+				if test.tokenStatus != 0 {
+					status, body = test.tokenStatus, `{"message":"Bad Request","errors":[{"resource":"AuthorizationCode","field":"code","code":"invalid"}]}`
+				}
+				return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
+			})}
+			t.Cleanup(func() {
+				stravaClient = oldStravaClient
+			})
+
+			ctx := context.Background()
+			store := database.CreateMemoryStore()
+
+			resp, err := handleRequest(store, ctx, test.req)
+			if err != nil {
+				t.Fatalf("handleRequest() got error %s", err.Error())
+			}
+			if resp.StatusCode != test.statusCode {
+				t.Fatalf("handleRequest() got status %d, expected %d", resp.StatusCode, test.statusCode)
+			}
+			if !strings.Contains(resp.Body, test.body) {
+				t.Fatalf("handleRequest() got body %q, expected it to contain %q", resp.Body, test.body)
+			}
+			if exchanges != test.exchanges {
+				t.Fatalf("handleRequest() exchanged %d codes, expected %d", exchanges, test.exchanges)
+			}
+
+			accessToken, accessErr := store.GetAccessToken(ctx, athleteId)
+			refreshToken, refreshErr := store.GetRefreshToken(ctx, athleteId)
+			if !test.saved {
+				if accessErr == nil || refreshErr == nil {
+					t.Fatalf("handleRequest() saved %+v and %+v, expected nothing", accessToken, refreshToken)
+				}
+				return
+			}
+			if accessToken.Code != "access" || accessToken.ExpiresAt != 4102444800 || accessToken.Scope != grantedScope || refreshToken.Code != "refresh" {
+				t.Fatalf("handleRequest() saved %+v and %+v, expected the exchanged tokens", accessToken, refreshToken)
+			}
+		})
+	}
+}
+
+func TestHandleAuthorize(t *testing.T) {
+	t.Setenv("STRAVA_CLIENT_ID", "42")
+
+	resp, err := handleAuthorize(createRequest("GET", "/", "", nil))
+	if err != nil {
+		t.Fatalf("handleAuthorize() got error %s", err.Error())
+	}
+
+	location, err := url.Parse(resp.Headers["Location"])
+	if err != nil {
+		t.Fatalf("handleAuthorize() redirected to invalid URL %s", resp.Headers["Location"])
+	}
+	query := location.Query()
+	if query.Get("client_id") != "42" || query.Get("redirect_uri") != "https://onboarding.example.com/callback" || query.Get("scope") != strava.Scope {
+		t.Fatalf("handleAuthorize() redirected to %s, expected client 42, the callback and scope %s", location, strava.Scope)
+	}
+
+	if len(resp.Cookies) != 1 || !strings.HasPrefix(resp.Cookies[0], stateCookie+"="+query.Get("state")+";") {
+		t.Fatalf("handleAuthorize() set cookies %v, expected %s with state %s", resp.Cookies, stateCookie, query.Get("state"))
+	}
+}
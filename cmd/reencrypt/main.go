@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"strava-wx/pkg/database"
+	"strava-wx/pkg/database/sqlstore"
+)
+
+type reencrypter interface {
+	ReencryptTokens(ctx context.Context) (int, error)
+}
+
+// reencrypt rewrites stored tokens with the key configured by TOKEN_KMS_KEY_ID
+// or TOKEN_KEY_FILE. Run it after enabling encryption or rotating keys.
+func main() {
+	sqlitePath := flag.String("sqlite", "", "path to a SQLite database to use instead of DynamoDB")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	var store reencrypter
+	if *sqlitePath != "" {
+		sqlStore, err := sqlstore.CreateSQLiteStore(ctx, *sqlitePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sqlStore.Close()
+		store = sqlStore
+	} else {
+		client, err := database.CreateClient(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = client
+	}
+
+	count, err := store.ReencryptTokens(ctx)
+	if err != nil {
+		log.Fatalf("Re-encrypted %d tokens before error: %s", count, err.Error())
+	}
+	log.Printf("Re-encrypted %d tokens.", count)
+}
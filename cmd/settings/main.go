@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"strava-wx/pkg/database"
+	"strava-wx/pkg/web/strava"
+	"strava-wx/pkg/web/weather"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+const stateCookie = "strava_wx_settings_state"
+const sessionCookie = "strava_wx_session"
+const sessionTTL = 12 * time.Hour
+
+var stravaClient = http.DefaultClient
+
+// sampleObservation is the weather used to preview descriptions.
+var sampleObservation = weather.Observation{
+	Provider:      "Open-Meteo",
+	IsDay:         true,
+	Condition:     weather.PartlyCloudy,
+	Temp:          18.0,
+	FeelsLike:     17.0,
+	Humidity:      65,
+	WindSpeed:     4.5,
+	WindGust:      8.0,
+	WindDeg:       225,
+	Precipitation: 0.0,
+}
+
+// fullObservation fills in every optional field, so that templates are
+// checked against the longest description they can produce.
+var fullObservation = weather.Observation{
+	Provider:      "Open-Meteo",
+	IsDay:         true,
+	Condition:     weather.PartlyCloudy,
+	Temp:          18.0,
+	FeelsLike:     17.0,
+	Humidity:      65,
+	WindSpeed:     4.5,
+	WindGust:      8.0,
+	WindDeg:       225,
+	Precipitation: 2.5,
+}
+
+var sportTypes = []string{
+	"Run", "TrailRun", "Walk", "Hike",
+	"Ride", "GravelRide", "MountainBikeRide", "EBikeRide",
+	"Swim", "Rowing", "Kayaking", "StandUpPaddling",
+	"AlpineSki", "BackcountrySki", "NordicSki", "Snowboard",
+	"InlineSkate", "IceSkate",
+}
+
+var unitOptions = []option{
+	{"", "Same as Strava"},
+	{string(weather.Imperial), "Imperial (°F, mph)"},
+	{string(weather.Metric), "Metric (°C, km/h)"},
+	{string(weather.MetricMps), "Metric (°C, m/s)"},
+	{string(weather.UK), "UK (°C, mph)"},
+}
+
+var languageOptions = []option{
+	{string(weather.English), "English"},
+	{string(weather.Spanish), "Español"},
+	{string(weather.French), "Français"},
+	{string(weather.German), "Deutsch"},
+}
+
+type option struct {
+	Value string
+	Label string
+}
+
+type settingsPage struct {
+	Settings   database.AthleteSettings
+	Units      []option
+	Languages  []option
+	SportTypes []sportType
+	Csrf       string
+	Preview    string
+	Message    string
+	Error      string
+}
+
+type sportType struct {
+	Name    string
+	Checked bool
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>strava-wx</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Link}}<p><a href="{{.Link}}">Log in</a></p>{{end}}
+</body>
+</html>
+`))
+
+var settingsForm = template.Must(template.New("settings").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>strava-wx settings</title>
+</head>
+<body>
+<h1>Settings</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form id="settings" method="post" action="/">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<p><label><input type="checkbox" name="paused"{{if .Settings.Paused}} checked{{end}}> Pause adding the weather to new activities</label></p>
+<p><label>Units <select name="units">
+{{- range .Units}}<option value="{{.Value}}"{{if eq .Value $.Settings.Units}} selected{{end}}>{{.Label}}</option>{{end -}}
+</select></label></p>
+<p><label>Language <select name="language">
+{{- range .Languages}}<option value="{{.Value}}"{{if eq .Value $.Settings.Language}} selected{{end}}>{{.Label}}</option>{{end -}}
+</select></label></p>
+<p><label><input type="checkbox" name="hide_emoji"{{if .Settings.HideEmoji}} checked{{end}}> Hide emoji</label></p>
+<p><label><input type="checkbox" name="prepend"{{if .Settings.Prepend}} checked{{end}}> Put the weather before my description</label></p>
+<p><label>Template (leave empty for the default)<br>
+<textarea name="template" rows="4" cols="60">{{.Settings.Template}}</textarea></label></p>
+<p>Preview</p>
+<pre id="preview">{{.Preview}}</pre>
+<fieldset>
+<legend>Activity types (leave all unchecked for every type)</legend>
+{{range .SportTypes}}<label><input type="checkbox" name="activity_types" value="{{.Name}}"{{if .Checked}} checked{{end}}> {{.Name}}</label><br>
+{{end}}</fieldset>
+<p><label><input type="checkbox" name="include_trainer"{{if .Settings.IncludeTrainer}} checked{{end}}> Include indoor trainer activities</label><br>
+<label><input type="checkbox" name="include_virtual"{{if .Settings.IncludeVirtual}} checked{{end}}> Include virtual activities, such as Zwift</label><br>
+<label><input type="checkbox" name="include_manual"{{if .Settings.IncludeManual}} checked{{end}}> Include manually entered activities</label></p>
+<p><button type="submit">Save</button></p>
+</form>
+<form method="post" action="/logout"><button type="submit">Log out</button></form>
+<script>
+const form = document.getElementById("settings");
+const preview = document.getElementById("preview");
+let timer;
+form.addEventListener("input", () => {
+  clearTimeout(timer);
+  timer = setTimeout(async () => {
+    const resp = await fetch("/preview", {method: "POST", body: new URLSearchParams(new FormData(form))});
+    preview.textContent = await resp.text();
+  }, 300);
+});
+</script>
+</body>
+</html>
+`))
+
+func renderPage(statusCode int, title, message string) events.LambdaFunctionURLResponse {
+	return renderPageWithLink(statusCode, title, message, "")
+}
+
+func renderPageWithLink(statusCode int, title, message, link string) (resp events.LambdaFunctionURLResponse) {
+	var sb strings.Builder
+	if err := page.Execute(&sb, map[string]string{"Title": title, "Message": message, "Link": link}); err != nil {
+		log.Println("ERROR:", err)
+		resp.StatusCode = http.StatusInternalServerError
+		return resp
+	}
+
+	resp.StatusCode = statusCode
+	resp.Headers = map[string]string{"Content-Type": "text/html; charset=utf-8"}
+	resp.Body = sb.String()
+	return resp
+}
+
+func renderSettings(statusCode int, data settingsPage) (resp events.LambdaFunctionURLResponse) {
+	data.Units, data.Languages = unitOptions, languageOptions
+	if data.Settings.Language == "" {
+		data.Settings.Language = string(weather.English)
+	}
+
+	for _, name := range sportTypes {
+		data.SportTypes = append(data.SportTypes, sportType{name, slices.Contains(data.Settings.ActivityTypes, name)})
+	}
+	// Keep types that were saved some other way so they are not lost on save.
+	for _, name := range data.Settings.ActivityTypes {
+		if !slices.Contains(sportTypes, name) {
+			data.SportTypes = append(data.SportTypes, sportType{name, true})
+		}
+	}
+
+	var sb strings.Builder
+	if err := settingsForm.Execute(&sb, data); err != nil {
+		log.Println("ERROR:", err)
+		resp.StatusCode = http.StatusInternalServerError
+		return resp
+	}
+
+	resp.StatusCode = statusCode
+	resp.Headers = map[string]string{"Content-Type": "text/html; charset=utf-8"}
+	resp.Body = sb.String()
+	return resp
+}
+
+func redirect(location string) events.LambdaFunctionURLResponse {
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusSeeOther,
+		Headers:    map[string]string{"Location": location},
+	}
+}
+
+func getSecret() []byte {
+	return []byte(os.Getenv("SESSION_SECRET"))
+}
+
+func sign(value string) string {
+	mac := hmac.New(sha256.New, getSecret())
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createSession returns a cookie value of the form athleteId.expiresAt.signature.
+func createSession(athleteId int, now time.Time) string {
+	value := strconv.Itoa(athleteId) + "." + strconv.FormatInt(now.Add(sessionTTL).Unix(), 10)
+	return value + "." + sign(value)
+}
+
+// verifySession returns the athlete ID from a session cookie value, or 0 if
+// the value is missing, tampered with or expired.
+func verifySession(session string, now time.Time) int {
+	parts := strings.Split(session, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+
+	expected := sign(parts[0] + "." + parts[1])
+	if subtle.ConstantTimeCompare([]byte(parts[2]), []byte(expected)) != 1 {
+		return 0
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return 0
+	}
+
+	athleteId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	return athleteId
+}
+
+// getCsrfToken ties form submissions to the session, so other sites cannot
+// post to the settings page on the athlete's behalf.
+func getCsrfToken(session string) string {
+	return sign("csrf." + session)
+}
+
+func getCookie(req events.LambdaFunctionURLRequest, name string) string {
+	for _, line := range req.Cookies {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+		for _, cookie := range cookies {
+			if cookie.Name == name {
+				return cookie.Value
+			}
+		}
+	}
+	return ""
+}
+
+func createCookie(name, value, path string, maxAge int) string {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
+
+func getRedirectUri(req events.LambdaFunctionURLRequest) string {
+	return "https://" + req.RequestContext.DomainName + "/callback"
+}
+
+func parseForm(req events.LambdaFunctionURLRequest) (url.Values, error) {
+	body := req.Body
+	if req.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+	return url.ParseQuery(body)
+}
+
+// parseSettings reads the editable settings from the form into settings and
+// checks that they are valid.
+func parseSettings(form url.Values, settings *database.AthleteSettings) error {
+	settings.Units = form.Get("units")
+	if settings.Units != "" {
+		if _, err := weather.ParseUnits(settings.Units); err != nil {
+			return err
+		}
+	}
+
+	language, err := weather.ParseLanguage(form.Get("language"))
+	if err != nil {
+		return err
+	}
+	settings.Language = string(language)
+	if language == weather.English {
+		settings.Language = ""
+	}
+
+	settings.Template = strings.TrimSpace(strings.ReplaceAll(form.Get("template"), "\r\n", "\n"))
+	if settings.Template != "" {
+		tmpl, err := weather.ParseTemplate(settings.Template)
+		if err != nil {
+			return err
+		}
+		// Rendering every field rejects templates that are too long for Strava.
+		if _, err = tmpl.Execute(fullObservation, weather.Format{Units: weather.Imperial, Language: language}); err != nil {
+			return err
+		}
+	}
+
+	settings.ActivityTypes = form["activity_types"]
+	settings.HideEmoji = form.Get("hide_emoji") != ""
+	settings.Prepend = form.Get("prepend") != ""
+	settings.Paused = form.Get("paused") != ""
+	settings.IncludeTrainer = form.Get("include_trainer") != ""
+	settings.IncludeVirtual = form.Get("include_virtual") != ""
+	settings.IncludeManual = form.Get("include_manual") != ""
+	return nil
+}
+
+// renderPreview writes the sample observation with the settings. Units that
+// follow Strava use the athlete's cached measurement preference, like the
+// worker does.
+func renderPreview(settings database.AthleteSettings) (string, error) {
+	var units weather.Units
+	var err error
+	switch {
+	case settings.Units != "":
+		units, err = weather.ParseUnits(settings.Units)
+	case settings.MeasurementPreference == "feet":
+		units = weather.Imperial
+	case settings.MeasurementPreference == "meters":
+		units = weather.Metric
+	default:
+		units, err = weather.GetDefaultUnits()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	language, err := weather.ParseLanguage(settings.Language)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl := weather.GetDefaultTemplate(language)
+	if settings.Template != "" {
+		if tmpl, err = weather.ParseTemplate(settings.Template); err != nil {
+			return "", err
+		}
+	}
+
+	format := weather.Format{Units: units, Language: language, HideEmoji: settings.HideEmoji}
+	return weather.GetWeatherDescription(sampleObservation, format, tmpl, os.Getenv("WEATHER_CREDIT") == "true")
+}
+
+func handleLogin(req events.LambdaFunctionURLRequest) (resp events.LambdaFunctionURLResponse, err error) {
+	log.Println("Received login request. Generating state...")
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	log.Println("State generated. Redirecting to Strava...")
+	resp.StatusCode = http.StatusFound
+	resp.Headers = map[string]string{"Location": strava.GetAuthorizeUrl(getRedirectUri(req), strava.Scope, state)}
+	resp.Cookies = []string{createCookie(stateCookie, state, "/callback", 600)}
+	return resp, nil
+}
+
+func handleCallback(client database.Store, ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	log.Println("Received callback. Verifying state...")
+	state := req.QueryStringParameters["state"]
+	cookie := getCookie(req, stateCookie)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		log.Println("State verification failed.")
+		return renderPageWithLink(http.StatusBadRequest, "Login expired", "Please log in again.", "/login"), nil
+	}
+
+	log.Println("State verified. Checking if authorization was granted...")
+	if e := req.QueryStringParameters["error"]; e != "" {
+		log.Println("Authorization was not granted:", e)
+		return renderPageWithLink(http.StatusForbidden, "Login cancelled", "Log in with Strava to change your settings.", "/login"), nil
+	}
+
+	log.Println("Authorization granted. Exchanging code for tokens...")
+	tokens, err := strava.ExchangeToken(stravaClient, req.QueryStringParameters["code"])
+	if strava.IsPermanent(err) {
+		log.Println("ERROR:", err)
+		return renderPageWithLink(http.StatusBadRequest, "Login expired", "Please log in again.", "/login"), nil
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusBadGateway, "Something went wrong", "Strava could not be reached. Please try again later."), nil
+	}
+	if tokens.Athlete.Id == 0 || tokens.Refresh_token == "" {
+		log.Println("Token exchange failed.")
+		return renderPageWithLink(http.StatusBadRequest, "Login expired", "Please log in again.", "/login"), nil
+	}
+
+	log.Printf("Athlete %d identified. Checking if athlete has onboarded...\n", tokens.Athlete.Id)
+	_, err = client.GetAccessToken(ctx, tokens.Athlete.Id)
+	var de *database.DatabaseError
+	if errors.As(err, &de) {
+		log.Println("Athlete has not onboarded.")
+		return renderPage(http.StatusForbidden, "Not signed up", "Connect your Strava account to strava-wx before changing your settings."), nil
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	// Logging in asks for the same scopes as onboarding, and Strava replaces
+	// the athlete's earlier grant, so the new tokens and scopes are saved.
+	log.Println("Athlete has onboarded. Saving access token...")
+	accessToken := database.AccessToken{AthleteId: tokens.Athlete.Id, Code: tokens.Access_token, ExpiresAt: tokens.Expires_at, Scope: req.QueryStringParameters["scope"]}
+	if err = client.UpdateAccessToken(ctx, accessToken); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Access token saved. Saving refresh token...")
+	refreshToken := database.RefreshToken{AthleteId: tokens.Athlete.Id, Code: tokens.Refresh_token}
+	if err = client.UpdateRefreshToken(ctx, refreshToken); err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Refresh token saved. Starting session...")
+	resp := redirect("/")
+	resp.Cookies = []string{
+		createCookie(stateCookie, "", "/callback", -1),
+		createCookie(sessionCookie, createSession(tokens.Athlete.Id, time.Now()), "/", int(sessionTTL.Seconds())),
+	}
+	return resp, nil
+}
+
+func handleSettings(client database.Store, ctx context.Context, req events.LambdaFunctionURLRequest, session string, athleteId int) (events.LambdaFunctionURLResponse, error) {
+	log.Println("Getting athlete settings...")
+	settings, err := client.GetAthleteSettings(ctx, athleteId)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+	data := settingsPage{Csrf: getCsrfToken(session)}
+
+	if req.RequestContext.HTTP.Method == "POST" {
+		log.Println("Athlete settings retrieved. Parsing form...")
+		form, err := parseForm(req)
+		if err != nil || subtle.ConstantTimeCompare([]byte(form.Get("csrf")), []byte(data.Csrf)) != 1 {
+			log.Println("Form verification failed.")
+			return renderPageWithLink(http.StatusForbidden, "Session expired", "Please log in again.", "/login"), nil
+		}
+
+		if err = parseSettings(form, &settings); err != nil {
+			log.Println("Settings are invalid:", err)
+			data.Settings, data.Error = settings, err.Error()
+			return renderSettings(http.StatusBadRequest, data), nil
+		}
+
+		log.Println("Form parsed. Saving athlete settings...")
+		if err = client.PutAthleteSettings(ctx, settings); err != nil {
+			log.Println("ERROR:", err)
+			return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+		}
+		log.Println("Athlete settings saved.")
+		data.Message = "Your settings have been saved."
+	}
+
+	data.Settings = settings
+	if data.Preview, err = renderPreview(settings); err != nil {
+		data.Preview = err.Error()
+	}
+	return renderSettings(http.StatusOK, data), nil
+}
+
+func handlePreview(client database.Store, ctx context.Context, req events.LambdaFunctionURLRequest, session string, athleteId int) (events.LambdaFunctionURLResponse, error) {
+	text := func(statusCode int, body string) events.LambdaFunctionURLResponse {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: statusCode,
+			Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+			Body:       body,
+		}
+	}
+
+	form, err := parseForm(req)
+	if err != nil || subtle.ConstantTimeCompare([]byte(form.Get("csrf")), []byte(getCsrfToken(session))) != 1 {
+		return text(http.StatusForbidden, "Session expired. Please log in again."), nil
+	}
+
+	settings, err := client.GetAthleteSettings(ctx, athleteId)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return text(http.StatusInternalServerError, "Something went wrong. Please try again later."), nil
+	}
+	if err = parseSettings(form, &settings); err != nil {
+		return text(http.StatusOK, err.Error()), nil
+	}
+
+	preview, err := renderPreview(settings)
+	if err != nil {
+		return text(http.StatusOK, err.Error()), nil
+	}
+	return text(http.StatusOK, preview), nil
+}
+
+func handleRequest(client database.Store, ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	method := req.RequestContext.HTTP.Method
+
+	switch {
+	case req.RawPath == "/login" && method == "GET":
+		return handleLogin(req)
+	case req.RawPath == "/callback" && method == "GET":
+		return handleCallback(client, ctx, req)
+	case req.RawPath == "/logout" && method == "POST":
+		resp := redirect("/login")
+		resp.Cookies = []string{createCookie(sessionCookie, "", "/", -1)}
+		return resp, nil
+	}
+
+	session := getCookie(req, sessionCookie)
+	athleteId := verifySession(session, time.Now())
+
+	switch {
+	case (req.RawPath == "" || req.RawPath == "/") && (method == "GET" || method == "POST"):
+		if athleteId == 0 {
+			return redirect("/login"), nil
+		}
+		return handleSettings(client, ctx, req, session, athleteId)
+	case req.RawPath == "/preview" && method == "POST":
+		if athleteId == 0 {
+			return events.LambdaFunctionURLResponse{StatusCode: http.StatusUnauthorized}, nil
+		}
+		return handlePreview(client, ctx, req, session, athleteId)
+	}
+	return events.LambdaFunctionURLResponse{StatusCode: http.StatusNotFound}, nil
+}
+
+func settingsHandler(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	if len(getSecret()) == 0 {
+		log.Println("ERROR: SESSION_SECRET is not set")
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Creating DynamoDB client...")
+	client, err := database.CreateClient(ctx)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return renderPage(http.StatusInternalServerError, "Something went wrong", "Please try again later."), nil
+	}
+
+	log.Println("Client created.")
+	return handleRequest(client, ctx, req)
+}
+
+func main() {
+	lambda.Start(settingsHandler)
+}
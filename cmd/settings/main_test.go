@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"strava-wx/pkg/database"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const athleteId = 1234
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func createRequest(method, path, session string, form url.Values) events.LambdaFunctionURLRequest {
+	req := events.LambdaFunctionURLRequest{RawPath: path, Body: form.Encode()}
+	req.RequestContext.HTTP.Method = method
+	req.RequestContext.DomainName = "settings.example.com"
+	if session != "" {
+		req.Cookies = []string{sessionCookie + "=" + session}
+	}
+	return req
+}
+
+func TestVerifySession(t *testing.T) {
+	t.Setenv("SESSION_SECRET", "secret")
+	now := time.Unix(1700000000, 0)
+	session := createSession(athleteId, now)
+
+	tests := map[string]struct {
+		session string
+		now     time.Time
+		result  int
+	}{
+		"valid": {
+			session: session,
+			now:     now,
+			result:  athleteId,
+		},
+		"expired": {
+			session: session,
+			now:     now.Add(sessionTTL),
+		},
+		"tampered": {
+			session: strings.Replace(session, "1234", "1235", 1),
+			now:     now,
+		},
+		"malformed": {
+			session: "1234",
+			now:     now,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if result := verifySession(test.session, test.now); result != test.result {
+				t.Fatalf("verifySession() got %d, expected %d", result, test.result)
+			}
+		})
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	t.Setenv("SESSION_SECRET", "secret")
+	t.Setenv("WEATHER_CREDIT", "")
+	session := createSession(athleteId, time.Now())
+	csrf := getCsrfToken(session)
+
+	tests := map[string]struct {
+		req        events.LambdaFunctionURLRequest
+		statusCode int
+		body       string
+		settings   database.AthleteSettings
+	}{
+		"not logged in": {
+			req:        createRequest("GET", "/", "", nil),
+			statusCode: http.StatusSeeOther,
+		},
+		"view": {
+			req:        createRequest("GET", "/", session, nil),
+			statusCode: http.StatusOK,
+			body:       "⛅ Partly cloudy, 64°F, Feels like 63°F, Humidity 65%, Wind 10mph with 18mph gusts from SW",
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"save": {
+			req: createRequest("POST", "/", session, url.Values{
+				"csrf":           {csrf},
+				"units":          {"metric"},
+				"language":       {"en"},
+				"template":       {"{{.temp}}\r\n{{.condition}}"},
+				"activity_types": {"Run", "Ride"},
+				"paused":         {"on"},
+				"include_manual": {"on"},
+			}),
+			statusCode: http.StatusOK,
+			body:       "Your settings have been saved.",
+			settings:   database.AthleteSettings{AthleteId: athleteId, Units: "metric", Template: "{{.temp}}\n{{.condition}}", ActivityTypes: []string{"Run", "Ride"}, Paused: true, IncludeManual: true},
+		},
+		"invalid template": {
+			req: createRequest("POST", "/", session, url.Values{
+				"csrf":     {csrf},
+				"template": {"{{.temperature}}"},
+			}),
+			statusCode: http.StatusBadRequest,
+			body:       "Unknown template field temperature",
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"template too long": {
+			req: createRequest("POST", "/", session, url.Values{
+				"csrf":     {csrf},
+				"template": {strings.Repeat("{{.condition}} ", 100)},
+			}),
+			statusCode: http.StatusBadRequest,
+			body:       "Description is longer than 1000 characters",
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"template too long with precipitation": {
+			req: createRequest("POST", "/", session, url.Values{
+				"csrf":     {csrf},
+				"template": {strings.Repeat("{{.condition}}{{.precip}} ", 60)},
+			}),
+			statusCode: http.StatusBadRequest,
+			body:       "Description is longer than 1000 characters",
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"missing csrf": {
+			req:        createRequest("POST", "/", session, url.Values{"paused": {"on"}}),
+			statusCode: http.StatusForbidden,
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"preview": {
+			req: createRequest("POST", "/preview", session, url.Values{
+				"csrf":       {csrf},
+				"units":      {"metric_ms"},
+				"language":   {"de"},
+				"hide_emoji": {"on"},
+			}),
+			statusCode: http.StatusOK,
+			body:       "Teilweise bewölkt, 18°C, Gefühlt 17°C, Luftfeuchtigkeit 65%, Wind 5m/s aus SW, Böen 8m/s",
+			settings:   database.AthleteSettings{AthleteId: athleteId},
+		},
+		"preview not logged in": {
+			req:        createRequest("POST", "/preview", "", url.Values{}),
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := database.CreateMemoryStore()
+
+			resp, err := handleRequest(store, ctx, test.req)
+			if err != nil {
+				t.Fatalf("handleRequest() got error %s", err.Error())
+			}
+			if resp.StatusCode != test.statusCode {
+				t.Fatalf("handleRequest() got status %d, expected %d", resp.StatusCode, test.statusCode)
+			}
+			if !strings.Contains(resp.Body, test.body) {
+				t.Fatalf("handleRequest() got body %q, expected it to contain %q", resp.Body, test.body)
+			}
+
+			if test.settings.AthleteId != 0 {
+				settings, _ := store.GetAthleteSettings(ctx, athleteId)
+				if settings.Units != test.settings.Units || settings.Template != test.settings.Template || settings.Paused != test.settings.Paused ||
+					settings.IncludeTrainer != test.settings.IncludeTrainer || settings.IncludeVirtual != test.settings.IncludeVirtual || settings.IncludeManual != test.settings.IncludeManual ||
+					strings.Join(settings.ActivityTypes, ",") != strings.Join(test.settings.ActivityTypes, ",") {
+					t.Fatalf("handleRequest() saved %+v, expected %+v", settings, test.settings)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderPreview(t *testing.T) {
+	t.Setenv("WEATHER_UNITS", "metric_ms")
+
+	tests := map[string]struct {
+		settings database.AthleteSettings
+		result   string
+	}{
+		"default units": {
+			result: "18°C",
+		},
+		"strava preference": {
+			settings: database.AthleteSettings{MeasurementPreference: "feet"},
+			result:   "64°F",
+		},
+		"chosen units": {
+			settings: database.AthleteSettings{Units: "metric", MeasurementPreference: "feet"},
+			result:   "16km/h",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			preview, err := renderPreview(test.settings)
+			if err != nil {
+				t.Fatalf("renderPreview() got error %s", err.Error())
+			}
+			if !strings.Contains(preview, test.result) {
+				t.Fatalf("renderPreview() got %q, expected it to contain %q", preview, test.result)
+			}
+		})
+	}
+}
+
+func TestHandleCallback(t *testing.T) {
+	const grantedScope = "read,activity:read_all,activity:write,profile:read_all"
+	t.Setenv("SESSION_SECRET", "secret")
+
+	oldStravaClient := stravaClient
+	stravaClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := `{"access_token":"new-access","expires_at":4102444800,"refresh_token":"new-refresh","athlete":{"id":1234}}`
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})}
+	t.Cleanup(func() {
+		stravaClient = oldStravaClient
+	})
+
+	tests := map[string]struct {
+		onboarded  bool
+		statusCode int
+		saved      bool
+	}{
+		"onboarded": {
+			onboarded:  true,
+			statusCode: http.StatusSeeOther,
+			saved:      true,
+		},
+		"not onboarded": {
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := database.CreateMemoryStore()
+			if test.onboarded {
+				store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: athleteId, Code: "access", ExpiresAt: 10, Scope: "read,activity:read_all,activity:write"})
+				store.UpdateRefreshToken(ctx, database.RefreshToken{AthleteId: athleteId, Code: "refresh"})
+			}
+
+			req := createRequest("GET", "/callback", "", nil)
+			req.QueryStringParameters = map[string]string{"state": "state", "code": "code", "scope": grantedScope}
+			req.Cookies = []string{stateCookie + "=state"}
+
+			resp, err := handleRequest(store, ctx, req)
+			if err != nil {
+				t.Fatalf("handleRequest() got error %s", err.Error())
+			}
+			if resp.StatusCode != test.statusCode {
+				t.Fatalf("handleRequest() got status %d, expected %d", resp.StatusCode, test.statusCode)
+			}
+
+			accessToken, accessErr := store.GetAccessToken(ctx, athleteId)
+			refreshToken, _ := store.GetRefreshToken(ctx, athleteId)
+			if !test.saved {
+				if accessErr == nil {
+					t.Fatalf("handleRequest() saved %+v, expected nothing", accessToken)
+				}
+				return
+			}
+			if accessToken.Code != "new-access" || accessToken.ExpiresAt != 4102444800 || accessToken.Scope != grantedScope || refreshToken.Code != "new-refresh" {
+				t.Fatalf("handleRequest() saved %+v and %+v, expected the exchanged tokens", accessToken, refreshToken)
+			}
+		})
+	}
+}
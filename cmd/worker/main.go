@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"strava-wx/pkg/database"
+	"strava-wx/pkg/queue"
 	"strava-wx/pkg/web/strava"
 	"strava-wx/pkg/web/weather"
 
@@ -17,33 +21,92 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
+var stravaClient = http.DefaultClient
+var weatherClient = &http.Client{Timeout: 10 * time.Second}
+
+// Updates to these fields cannot change the weather, and include the ones our
+// own writes touch, so reacting to them would only cause loops.
+var ignoredUpdates = map[string]bool{
+	"title":       true,
+	"type":        true,
+	"sport_type":  true,
+	"private":     true,
+	"visibility":  true,
+	"description": true,
+}
+
 type webhookEvent struct {
 	Object_type string
 	Object_id   int
 	Aspect_type string
+	Updates     map[string]any
 	Owner_id    int
 	Event_time  int
 }
 
-func workerHandler(ctx context.Context, req events.SQSEvent) error {
+func (e webhookEvent) hasWeatherUpdates() bool {
+	for field := range e.Updates {
+		if !ignoredUpdates[field] {
+			return true
+		}
+	}
+	return false
+}
+
+func (e webhookEvent) isDeauthorization() bool {
+	authorized, ok := e.Updates["authorized"]
+	return ok && fmt.Sprint(authorized) == "false"
+}
+
+func workerHandler(ctx context.Context, req events.SQSEvent) (events.SQSEventResponse, error) {
 	log.Println("Received POST request. Creating DynamoDB client...")
 	client, err := database.CreateClient(ctx)
 	if err != nil {
 		log.Println("ERROR:", err)
-		return err
+		return events.SQSEventResponse{}, err
+	}
+
+	log.Println("Client created.")
+	return processRecords(client, ctx, req)
+}
+
+func processRecords(client database.Store, ctx context.Context, req events.SQSEvent) (resp events.SQSEventResponse, err error) {
+	log.Println("Checking Strava rate limit usage...")
+	usage, err := client.GetRateLimitUsage(ctx)
+	if err != nil {
+		log.Println("ERROR:", err)
+		return resp, err
+	}
+
+	if delay := usage.GetDelay(time.Now(), getRateLimitThreshold()); delay > 0 {
+		log.Printf("Strava rate limit is nearly reached. Deferring messages for %s...\n", delay)
+		if err = deferRecords(ctx, req.Records, delay); err != nil {
+			log.Println("ERROR:", err)
+			return resp, err
+		}
+		for _, record := range req.Records {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+		log.Println("Messages deferred.")
+		return resp, nil
 	}
 
 	var wg sync.WaitGroup
-	errorChan := make(chan error, len(req.Records))
+	failureChan := make(chan string, len(req.Records))
 	wg.Add(len(req.Records))
 
-	log.Println("Client created. Processing messages...")
+	log.Println("Rate limit usage checked. Processing messages...")
 	for i, record := range req.Records {
 		go func(i int, record events.SQSMessage) {
 			log.Printf("Processing record %d...\n", i)
 			if err := processRecord(client, ctx, record); err != nil {
 				log.Println("ERROR:", err)
-				errorChan <- err
+				if isPermanent(err) {
+					log.Printf("Record %d failed permanently. Dropping message...\n", i)
+				} else {
+					log.Printf("Record %d failed. Leaving message on queue...\n", i)
+					failureChan <- record.MessageId
+				}
 			} else {
 				log.Printf("Record %d processed.\n", i)
 			}
@@ -52,133 +115,429 @@ func workerHandler(ctx context.Context, req events.SQSEvent) error {
 	}
 
 	wg.Wait()
-	close(errorChan)
+	close(failureChan)
+
+	if rl, ok := strava.LatestRateLimit(); ok {
+		log.Println("Saving Strava rate limit usage...")
+		usage := database.RateLimitUsage{
+			ShortLimit: rl.ShortLimit,
+			ShortUsage: rl.ShortUsage,
+			DailyLimit: rl.DailyLimit,
+			DailyUsage: rl.DailyUsage,
+			UpdatedAt:  int(rl.Time.Unix()),
+		}
+		if err := client.UpdateRateLimitUsage(ctx, usage); err != nil {
+			log.Println("ERROR:", err)
+		} else {
+			log.Println("Rate limit usage saved.")
+		}
+	}
+
+	for messageId := range failureChan {
+		resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: messageId})
+	}
+
+	log.Printf("All messages processed. %d failed.\n", len(resp.BatchItemFailures))
+	return resp, nil
+}
+
+// parseError is returned for a record body that is not a webhook event. The
+// body will never parse, so retrying it is pointless.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "Invalid record body: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var de *database.DatabaseError
+	var pe *parseError
+	return errors.As(err, &de) || errors.As(err, &pe) ||
+		weather.IsPermanent(err) || strava.IsPermanent(err)
+}
+
+func getRateLimitThreshold() float64 {
+	if threshold, err := strconv.ParseFloat(os.Getenv("STRAVA_RATE_LIMIT_THRESHOLD"), 64); err == nil {
+		return threshold
+	}
+	return 0.9
+}
+
+func deferRecords(ctx context.Context, records []events.SQSMessage, delay time.Duration) error {
+	log.Println("Creating SQS client...")
+	client, err := queue.CreateClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	// SQS caps the visibility timeout at 12 hours.
+	timeout := int32(min(delay+time.Second, 12*time.Hour).Seconds())
 
-	select {
-	case err := <-errorChan:
-		var de *database.DatabaseError
-		var we *weather.WeatherError
-		if !errors.As(err, &de) && !errors.As(err, &we) {
+	log.Println("Client created. Changing message visibility...")
+	for _, record := range records {
+		queueUrl, err := queue.GetQueueUrl(record.EventSourceARN)
+		if err != nil {
+			return err
+		}
+		if err = client.ChangeVisibility(ctx, record.ReceiptHandle, queueUrl, timeout); err != nil {
 			return err
 		}
-	default:
 	}
 
-	log.Println("All messages processed.")
+	log.Println("Message visibility changed.")
 	return nil
 }
 
-func processRecord(client database.DynamoDBClient, ctx context.Context, record events.SQSMessage) error {
+func processRecord(client database.Store, ctx context.Context, record events.SQSMessage) error {
 	log.Println("Parsing record...")
 	var event webhookEvent
 	if err := json.Unmarshal([]byte(record.Body), &event); err != nil {
+		return &parseError{err}
+	}
+
+	log.Println("Record parsed. Checking event type...")
+	switch {
+	case event.Object_type == "activity" && event.Aspect_type == "create":
+		log.Println("Event is a new activity.")
+		return processActivityEvent(client, ctx, event)
+
+	case event.Object_type == "activity" && event.Aspect_type == "update":
+		log.Println("Event is an activity update. Checking if weather-relevant fields changed...")
+		if !event.hasWeatherUpdates() {
+			log.Println("No weather-relevant fields changed. Returning...")
+			return nil
+		}
+		log.Println("Weather-relevant fields changed.")
+		return processActivityEvent(client, ctx, event)
+
+	case event.Object_type == "athlete" && event.isDeauthorization():
+		log.Println("Event is an athlete deauthorization.")
+		return deauthorizeAthlete(client, ctx, event.Object_id)
+
+	default:
+		log.Println("Event is not an activity creation, activity update or deauthorization. Returning...")
+	}
+
+	return nil
+}
+
+// deauthorizeAthlete deletes everything stored about the athlete, as Strava's
+// API agreement requires once access is revoked.
+func deauthorizeAthlete(client database.Store, ctx context.Context, athleteId int) error {
+	log.Println("Deleting athlete data...")
+	if err := client.DeleteAthlete(ctx, athleteId); err != nil {
+		return err
+	}
+
+	log.Println("Athlete data deleted.")
+	return nil
+}
+
+// processActivityEvent loads the athlete's settings once and uses them for
+// every step of processing the event.
+func processActivityEvent(client database.Store, ctx context.Context, event webhookEvent) error {
+	log.Println("Getting athlete settings...")
+	settings, err := client.GetAthleteSettings(ctx, event.Owner_id)
+	if err != nil {
 		return err
 	}
+	log.Println("Athlete settings retrieved.")
+
+	return processActivityOnce(client, ctx, event, settings)
+}
+
+func processActivityOnce(client database.Store, ctx context.Context, event webhookEvent, settings database.AthleteSettings) error {
+	log.Println("Claiming event...")
+	entry := database.ProcessedActivity{
+		ActivityId: event.Object_id,
+		AthleteId:  event.Owner_id,
+		Aspect:     event.Aspect_type,
+		EventTime:  event.Event_time,
+	}
+	claimed, err := client.ClaimProcessedActivity(ctx, &entry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		if entry.Status == database.ActivityProcessing {
+			return fmt.Errorf("event for activity %d is already being processed", event.Object_id)
+		}
+		log.Printf("Event was already processed with outcome %q. Returning...\n", entry.Outcome)
+		return nil
+	}
+	log.Println("Event claimed.")
+
+	err = processActivity(client, ctx, event, settings, &entry)
+
+	entry.Status = database.ActivityDone
+	entry.ProcessedAt = int(time.Now().Unix())
+	if err != nil {
+		entry.Outcome = err.Error()
+		if !isPermanent(err) {
+			entry.Status = database.ActivityFailed
+		}
+	}
+
+	log.Println("Recording outcome...")
+	if err := client.UpdateProcessedActivity(ctx, entry); err != nil {
+		log.Println("ERROR:", err)
+	} else {
+		log.Println("Outcome recorded.")
+	}
+	return err
+}
+
+func processActivity(client database.Store, ctx context.Context, event webhookEvent, settings database.AthleteSettings, entry *database.ProcessedActivity) error {
+	log.Println("Checking if athlete has paused processing...")
+	if settings.Paused {
+		log.Println("Athlete has paused processing. Returning...")
+		entry.Outcome = "paused"
+		return nil
+	}
 
-	log.Println("Record parsed. Checking if event is a new activity...")
-	if event.Object_type == "activity" && event.Aspect_type == "create" {
-		log.Println("Event is a new activity. Getting access token...")
-		accessToken, err := client.GetAccessToken(ctx, event.Owner_id)
+	log.Println("Athlete has not paused processing. Getting access token...")
+	accessToken, err := client.GetAccessToken(ctx, event.Owner_id)
+	if err != nil {
+		return err
+	}
+	log.Println("Retrieved access token. Checking scopes...")
+
+	// Athletes onboarded by hand have no stored scopes, so assume they are fine.
+	if accessToken.Scope != "" && !strava.HasRequiredScopes(accessToken.Scope) {
+		log.Printf("Athlete %d did not grant the required scopes: %s\n", accessToken.AthleteId, accessToken.Scope)
+		if !accessToken.InsufficientScope {
+			log.Println("Flagging athlete...")
+			if err = client.FlagInsufficientScope(ctx, accessToken); err != nil {
+				return err
+			}
+			log.Println("Athlete flagged.")
+		}
+		log.Println("Returning...")
+		entry.Outcome = "insufficient scope"
+		return nil
+	}
+	log.Println("Scopes checked.")
+
+	if err = checkAccessToken(client, ctx, &accessToken); err != nil {
+		return err
+	}
+
+	log.Println("Getting activity...")
+	activity, err := strava.GetActivity(stravaClient, event.Object_id, accessToken.Code)
+	if strava.IsNotFound(err) {
+		log.Println("Activity not found. It may have been deleted. Returning...")
+		entry.Outcome = "activity not found"
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Activity retrieved. Checking if activity should be skipped...")
+	if reason := getSkipReason(activity, settings); reason != "" {
+		log.Printf("Skipping %s activity: %s. Returning...\n", activity.Sport_type, reason)
+		entry.Outcome = reason
+		return nil
+	}
+
+	log.Println("Activity is not skipped. Checking if activity has start coordinates...")
+	if len(activity.Start_latlng) == 2 {
+		log.Println("Activity has start coordinates. Creating weather provider...")
+		provider, err := weather.CreateProvider(weatherClient)
 		if err != nil {
 			return err
 		}
-		log.Println("Retrieved access token.")
 
-		if err = checkAccessToken(client, ctx, &accessToken); err != nil {
+		log.Println("Weather provider created.")
+		format, err := getFormat(client, ctx, settings, accessToken.Code)
+		if err != nil {
 			return err
 		}
+		tmpl := getTemplate(settings, format.Language)
 
-		log.Println("Getting activity...")
-		activity, err := strava.GetActivity(http.DefaultClient, event.Object_id, accessToken.Code)
+		log.Printf("Getting weather from %s...\n", provider.Name())
+		obs, err := weather.GetObservation(provider, activity.Start_latlng[0], activity.Start_latlng[1], activity.Start_date)
 		if err != nil {
 			return err
 		}
+		log.Printf("Weather retrieved from %s. Getting weather description...\n", obs.Provider)
+		entry.Provider = obs.Provider
 
-		log.Println("Activity retrieved. Checking if activity has start coordinates...")
-		if len(activity.Start_latlng) == 2 {
-			log.Println("Activity has start coordinates. Getting weather description...")
-			description, err := weather.GetWeatherDescription(http.DefaultClient, os.Getenv("WEATHER_API_KEY"), activity.Start_latlng[0], activity.Start_latlng[1], activity.Start_date)
-			if err != nil {
-				return err
-			}
-			log.Println("Weather description retrieved.")
-
-			if err = checkAccessToken(client, ctx, &accessToken); err != nil {
-				return err
-			}
+		credit := os.Getenv("WEATHER_CREDIT") == "true"
+		description, err := weather.GetWeatherDescription(obs, format, tmpl, credit)
+		if err != nil && settings.Template != "" {
+			log.Println("ERROR:", err)
+			log.Println("Custom template failed to render. Using default template.")
+			description, err = weather.GetWeatherDescription(obs, format, weather.GetDefaultTemplate(format.Language), credit)
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("Weather description retrieved.")
 
-			log.Println("Updating activity...")
-			if err = strava.UpdateActivity(http.DefaultClient, event.Object_id, accessToken.Code, description); err != nil {
-				return err
-			}
-			log.Println("Activity updated.")
+		if err = checkAccessToken(client, ctx, &accessToken); err != nil {
+			return err
+		}
 
-		} else {
-			log.Println("Activity does not have start coordinates. Returning...")
+		log.Println("Updating activity...")
+		description = strava.MergeDescription(activity.Description, description, settings.Prepend)
+		if err = strava.UpdateActivity(stravaClient, event.Object_id, accessToken.Code, strava.UpdatableActivity{Description: &description}); err != nil {
+			return err
 		}
+		log.Println("Activity updated.")
+		entry.Outcome = "updated"
 
 	} else {
-		log.Println("Event is not activity creation. Returning...")
+		log.Println("Activity does not have start coordinates. Returning...")
+		entry.Outcome = "no start coordinates"
 	}
 
 	return nil
 }
 
-func checkAccessToken(client database.DynamoDBClient, ctx context.Context, accessToken *database.AccessToken) error {
-	log.Println("Checking if access token is expired...")
-	if accessToken.IsExpired() {
-		log.Println("Access token is expired. Getting refresh token...")
-		refreshToken, err := client.GetRefreshToken(ctx, accessToken.AthleteId)
+// getSkipReason returns why the athlete's settings exclude the activity from
+// getting the weather, or an empty string if it should be processed.
+func getSkipReason(activity strava.ActivityResponse, settings database.AthleteSettings) string {
+	switch {
+	case !settings.IsActivityTypeEnabled(activity.Sport_type):
+		return "activity type disabled"
+	case activity.Manual && !settings.IncludeManual:
+		return "manual activity"
+	case activity.IsVirtual() && !settings.IncludeVirtual:
+		return "virtual activity"
+	case activity.Trainer && !settings.IncludeTrainer:
+		return "trainer activity"
+	}
+	return ""
+}
+
+func getFormat(client database.Store, ctx context.Context, settings database.AthleteSettings, accessToken string) (weather.Format, error) {
+	units, err := getUnits(client, ctx, settings, accessToken)
+	if err != nil {
+		return weather.Format{}, err
+	}
+
+	language, err := weather.ParseLanguage(settings.Language)
+	if err != nil {
+		return weather.Format{}, err
+	}
+
+	return weather.Format{Units: units, Language: language, HideEmoji: settings.HideEmoji}, nil
+}
+
+func getUnits(client database.Store, ctx context.Context, settings database.AthleteSettings, accessToken string) (weather.Units, error) {
+	log.Println("Checking if athlete has a units override...")
+	if settings.Units != "" {
+		log.Println("Athlete has a units override.")
+		return weather.ParseUnits(settings.Units)
+	}
+
+	log.Println("Athlete has no units override. Checking if measurement preference is expired...")
+	if settings.IsMeasurementPreferenceExpired() {
+		log.Println("Measurement preference is expired. Getting athlete...")
+		athlete, err := strava.GetAthlete(stravaClient, accessToken)
 		if err != nil {
-			return err
+			// The units only affect the wording, so fall back to the default
+			// units rather than failing the activity.
+			log.Println("ERROR:", err)
+			log.Println("Could not get athlete. Using default units...")
+			return weather.GetDefaultUnits()
 		}
 
-		log.Println("Refresh token retrieved. Getting new tokens...")
-		newTokens, err := strava.GetNewTokens(refreshToken.Code)
-		if err != nil {
-			return err
+		log.Println("Athlete retrieved. Updating measurement preference...")
+		settings.MeasurementPreference = athlete.Measurement_preference
+		settings.MeasurementPreferenceCheckedAt = int(time.Now().Unix())
+		if err = client.UpdateMeasurementPreference(ctx, settings); err != nil {
+			return "", err
 		}
-		log.Println("New tokens retrieved.")
+		log.Println("Measurement preference updated.")
+	}
 
-		errorChan := make(chan error, 2)
-		var wg sync.WaitGroup
-		wg.Add(2)
+	switch settings.MeasurementPreference {
+	case "feet":
+		return weather.Imperial, nil
+	case "meters":
+		return weather.Metric, nil
+	}
+	return weather.GetDefaultUnits()
+}
 
-		go func() {
-			log.Println("Updating access token...")
-			accessToken.Code = newTokens.Access_token
-			accessToken.ExpiresAt = newTokens.Expires_at
-			if err = client.UpdateAccessToken(ctx, *accessToken); err != nil {
-				errorChan <- err
-			} else {
-				log.Println("Access token updated.")
-			}
-			wg.Done()
-		}()
+func getTemplate(settings database.AthleteSettings, language weather.Language) weather.Template {
+	log.Println("Checking if athlete has a custom template...")
+	if settings.Template == "" {
+		log.Println("Athlete has no custom template. Using default template.")
+		return weather.GetDefaultTemplate(language)
+	}
 
-		go func() {
-			log.Println("Updating refresh token...")
-			refreshToken.Code = newTokens.Refresh_token
-			if err = client.UpdateRefreshToken(ctx, refreshToken); err != nil {
-				errorChan <- err
-			} else {
-				log.Println("Refresh token updated.")
-			}
-			wg.Done()
-		}()
+	tmpl, err := weather.ParseTemplate(settings.Template)
+	if err != nil {
+		log.Println("ERROR:", err)
+		log.Println("Custom template is invalid. Using default template.")
+		return weather.GetDefaultTemplate(language)
+	}
 
-		wg.Wait()
-		close(errorChan)
+	log.Println("Using custom template.")
+	return tmpl
+}
 
-		select {
-		case err := <-errorChan:
-			return err
-		default:
+func checkAccessToken(client database.Store, ctx context.Context, accessToken *database.AccessToken) error {
+	log.Println("Checking if access token is expired...")
+	if !accessToken.IsExpired() {
+		return nil
+	}
+
+	log.Println("Access token is expired. Getting refresh token...")
+	refreshToken, err := client.GetRefreshToken(ctx, accessToken.AthleteId)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Refresh token retrieved. Getting new tokens...")
+	newTokens, err := strava.GetNewTokens(stravaClient, refreshToken.Code)
+	if err != nil {
+		// Another invocation may have used the refresh token first, in which
+		// case Strava rejects it but the stored access token is fresh.
+		if reloadAccessToken(client, ctx, accessToken) == nil && !accessToken.IsExpired() {
+			return nil
 		}
+		return err
+	}
+	log.Println("New tokens retrieved.")
+
+	newAccessToken := *accessToken
+	newAccessToken.Code = newTokens.Access_token
+	newAccessToken.ExpiresAt = newTokens.Expires_at
+	newRefreshToken := database.RefreshToken{AthleteId: accessToken.AthleteId, Code: newTokens.Refresh_token}
 
-		log.Println("Tokens updated.")
+	log.Println("Updating tokens...")
+	replaced, err := client.ReplaceTokens(ctx, refreshToken, newAccessToken, newRefreshToken)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		log.Println("Tokens were refreshed by another invocation.")
+		return reloadAccessToken(client, ctx, accessToken)
 	}
 
+	*accessToken = newAccessToken
+	log.Println("Tokens updated.")
+	return nil
+}
+
+func reloadAccessToken(client database.Store, ctx context.Context, accessToken *database.AccessToken) error {
+	log.Println("Reloading access token...")
+	token, err := client.GetAccessToken(ctx, accessToken.AthleteId)
+	if err != nil {
+		return err
+	}
+	*accessToken = token
 	return nil
 }
 
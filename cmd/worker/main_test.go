@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"strava-wx/pkg/database"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const athleteId = 1234
+const activityId = 5678
+
+const openMeteoBody = `{
+  "hourly": {
+    "time": ["2023-11-14T14:00"],
+    "temperature_2m": [10.0],
+    "apparent_temperature": [8.0],
+    "relative_humidity_2m": [50],
+    "precipitation": [0.5],
+    "weather_code": [61],
+    "wind_speed_10m": [5.0],
+    "wind_direction_10m": [180],
+    "wind_gusts_10m": [0.0],
+    "is_day": [1]
+  }
+}`
+
+type fakeApi struct {
+	mu             sync.Mutex
+	activityStatus int
+	activity       string
+	updates        []string
+	refreshes      int
+	tokenStatus    int
+	athleteStatus  int
+}
+
+func respond(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func (f *fakeApi) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	activityPath := "/api/v3/activities/" + strconv.Itoa(activityId)
+	switch {
+	case req.URL.Host == "archive-api.open-meteo.com":
+		return respond(http.StatusOK, openMeteoBody), nil
+
+	case req.Method == "GET" && req.URL.Path == activityPath:
+		if f.activityStatus != 0 {
+			return respond(f.activityStatus, `{"message":"error","errors":[]}`), nil
+		}
+		return respond(http.StatusOK, f.activity), nil
+
+	case req.Method == "PUT" && req.URL.Path == activityPath:
+		var update struct{ Description string }
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			return nil, err
+		}
+		f.updates = append(f.updates, update.Description)
+		return respond(http.StatusOK, "{}"), nil
+
+	case req.Method == "GET" && req.URL.Path == "/api/v3/athlete":
+		if f.athleteStatus != 0 {
+			return respond(f.athleteStatus, `{"message":"error","errors":[]}`), nil
+		}
+		return respond(http.StatusOK, `{"id":1234,"measurement_preference":"meters"}`), nil
+
+	case req.Method == "POST" && req.URL.Path == "/api/v3/oauth/token":
+		f.refreshes++
+		if f.tokenStatus != 0 {
+			return respond(f.tokenStatus, `{"message":"Bad Request","errors":[{"resource":"RefreshToken","field":"refresh_token","code":"invalid"}]}`), nil
+		}
+		return respond(http.StatusOK, `{"access_token":"new-access","expires_at":4102444800,"refresh_token":"new-refresh"}`), nil
+	}
+
+	return respond(http.StatusNotFound, `{"message":"Record Not Found","errors":[]}`), nil
+}
+
+func setup(t *testing.T, expiresAt int) (*database.MemoryStore, *fakeApi) {
+	t.Setenv("WEATHER_PROVIDER", "openmeteo")
+	t.Setenv("WEATHER_CREDIT", "")
+	t.Setenv("WEATHER_UNITS", "")
+
+	api := &fakeApi{activity: `{"description":"Great run","sport_type":"Run","start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`}
+	client := &http.Client{Transport: api}
+
+	oldStravaClient, oldWeatherClient := stravaClient, weatherClient
+	stravaClient, weatherClient = client, client
+	t.Cleanup(func() {
+		stravaClient, weatherClient = oldStravaClient, oldWeatherClient
+	})
+
+	ctx := context.Background()
+	store := database.CreateMemoryStore()
+	store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: athleteId, Code: "access", ExpiresAt: expiresAt, Scope: "read,activity:read_all,activity:write"})
+	store.UpdateRefreshToken(ctx, database.RefreshToken{AthleteId: athleteId, Code: "refresh"})
+	return store, api
+}
+
+func createEvent(objectType, aspectType string, objectId int, updates string) events.SQSEvent {
+	body := `{"object_type":"` + objectType + `","object_id":` + strconv.Itoa(objectId) + `,"aspect_type":"` + aspectType +
+		`","updates":` + updates + `,"owner_id":` + strconv.Itoa(athleteId) + `,"event_time":1700000000}`
+	return events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m0", Body: body}}}
+}
+
+func TestHasWeatherUpdates(t *testing.T) {
+	tests := map[string]struct {
+		updates map[string]any
+		result  bool
+	}{
+		"create":             {updates: nil, result: false},
+		"title only":         {updates: map[string]any{"title": "Renamed"}, result: false},
+		"own description":    {updates: map[string]any{"description": "Great run"}, result: false},
+		"title and type":     {updates: map[string]any{"title": "Renamed", "type": "Ride"}, result: false},
+		"location":           {updates: map[string]any{"start_latlng": "[41.87,-87.62]"}, result: true},
+		"title and location": {updates: map[string]any{"title": "Renamed", "start_latlng": "[41.87,-87.62]"}, result: true},
+		"start date":         {updates: map[string]any{"start_date": "2023-11-14T14:10:00Z"}, result: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			event := webhookEvent{Object_type: "activity", Aspect_type: "update", Updates: test.updates}
+			if got := event.hasWeatherUpdates(); got != test.result {
+				t.Fatalf("hasWeatherUpdates() got %t, expected %t", got, test.result)
+			}
+		})
+	}
+}
+
+func TestProcessRecordsCreate(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	ctx := context.Background()
+
+	resp, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}"))
+	if err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("processRecords() got failures %+v, expected none", resp.BatchItemFailures)
+	}
+
+	expected := "Great run\n\n\u2063🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 18km/h from S, Precipitation 0.5 mm/hr\u2063"
+	if len(api.updates) != 1 || api.updates[0] != expected {
+		t.Fatalf("processRecords() sent updates %q, expected [%q]", api.updates, expected)
+	}
+
+	entry, ok := store.GetProcessedActivity(ctx, activityId, "create", 1700000000)
+	if !ok || entry.Status != database.ActivityDone || entry.Outcome != "updated" || entry.Provider != "Open-Meteo" {
+		t.Fatalf("processRecords() recorded %+v, expected updated by Open-Meteo", entry)
+	}
+
+	stats, _ := store.GetAthleteStats(ctx, athleteId)
+	if stats.ActivitiesProcessed != 1 || stats.LastProcessedAt != entry.ProcessedAt {
+		t.Fatalf("processRecords() recorded stats %+v, expected 1 activity processed at %d", stats, entry.ProcessedAt)
+	}
+
+	settings, _ := store.GetAthleteSettings(ctx, athleteId)
+	if settings.MeasurementPreference != "meters" {
+		t.Fatalf("processRecords() cached measurement preference %q, expected meters", settings.MeasurementPreference)
+	}
+	if api.refreshes != 0 {
+		t.Fatalf("processRecords() refreshed tokens %d times, expected 0", api.refreshes)
+	}
+}
+
+func TestProcessRecordsUpdateReplacesWeather(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	api.activity = `{"description":"Great run\n\n\u2063☀️ Clear, 20°C\u2063","sport_type":"Run","start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`
+	ctx := context.Background()
+
+	if _, err := processRecords(store, ctx, createEvent("activity", "update", activityId, `{"start_latlng":"[41.87,-87.62]"}`)); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+
+	expected := "Great run\n\n\u2063🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 18km/h from S, Precipitation 0.5 mm/hr\u2063"
+	if len(api.updates) != 1 || api.updates[0] != expected {
+		t.Fatalf("processRecords() sent updates %q, expected [%q]", api.updates, expected)
+	}
+}
+
+func TestProcessRecordsSettings(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	ctx := context.Background()
+	store.PutAthleteSettings(ctx, database.AthleteSettings{AthleteId: athleteId, Units: "uk", Language: "es", HideEmoji: true, Prepend: true})
+
+	if _, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}")); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+
+	expected := "\u2063Lluvia, 10°C, Sensación térmica 8°C, Humedad 50%, Viento 11mph del S, Precipitación 0.5 mm/hr\u2063\n\nGreat run"
+	if len(api.updates) != 1 || api.updates[0] != expected {
+		t.Fatalf("processRecords() sent updates %q, expected [%q]", api.updates, expected)
+	}
+}
+
+func TestProcessRecordsTemplateTooLong(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	ctx := context.Background()
+	store.PutAthleteSettings(ctx, database.AthleteSettings{AthleteId: athleteId, Units: "metric", Template: strings.Repeat("{{.condition}} {{.precip}} ", 100)})
+
+	if _, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}")); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+
+	expected := "Great run\n\n\u2063🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 18km/h from S, Precipitation 0.5 mm/hr\u2063"
+	if len(api.updates) != 1 || api.updates[0] != expected {
+		t.Fatalf("processRecords() sent updates %q, expected [%q]", api.updates, expected)
+	}
+}
+
+func TestProcessRecordsAthleteUnavailable(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	t.Setenv("WEATHER_UNITS", "uk")
+	api.athleteStatus = http.StatusServiceUnavailable
+	ctx := context.Background()
+
+	resp, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}"))
+	if err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("processRecords() got failures %+v, expected none", resp.BatchItemFailures)
+	}
+
+	expected := "Great run\n\n\u2063🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 11mph from S, Precipitation 0.5 mm/hr\u2063"
+	if len(api.updates) != 1 || api.updates[0] != expected {
+		t.Fatalf("processRecords() sent updates %q, expected [%q]", api.updates, expected)
+	}
+
+	settings, _ := store.GetAthleteSettings(ctx, athleteId)
+	if settings.MeasurementPreferenceCheckedAt != 0 {
+		t.Fatalf("processRecords() cached measurement preference checked at %d, expected nothing", settings.MeasurementPreferenceCheckedAt)
+	}
+}
+
+func TestProcessRecordsDuplicate(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	ctx := context.Background()
+
+	for range 2 {
+		if _, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}")); err != nil {
+			t.Fatalf("processRecords() got error %s", err.Error())
+		}
+	}
+	if len(api.updates) != 1 {
+		t.Fatalf("processRecords() sent %d updates, expected 1", len(api.updates))
+	}
+}
+
+func TestProcessActivityOnce(t *testing.T) {
+	tests := map[string]struct {
+		existing  string
+		claimedAt time.Time
+		failed    bool
+		updates   int
+		status    string
+	}{
+		"new event": {
+			updates: 1,
+			status:  database.ActivityDone,
+		},
+		"already done": {
+			existing:  database.ActivityDone,
+			claimedAt: time.Now().Add(-time.Hour),
+			status:    database.ActivityDone,
+		},
+		"previously failed": {
+			existing:  database.ActivityFailed,
+			claimedAt: time.Now().Add(-time.Minute),
+			updates:   1,
+			status:    database.ActivityDone,
+		},
+		"in progress elsewhere": {
+			existing:  database.ActivityProcessing,
+			claimedAt: time.Now().Add(-time.Minute),
+			failed:    true,
+			status:    database.ActivityProcessing,
+		},
+		"abandoned": {
+			existing:  database.ActivityProcessing,
+			claimedAt: time.Now().Add(-time.Hour),
+			updates:   1,
+			status:    database.ActivityDone,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+			ctx := context.Background()
+			event := webhookEvent{Object_type: "activity", Object_id: activityId, Aspect_type: "create", Owner_id: athleteId, Event_time: 1700000000}
+
+			if test.existing != "" {
+				entry := database.ProcessedActivity{ActivityId: activityId, AthleteId: athleteId, Aspect: "create", EventTime: 1700000000}
+				store.ClaimProcessedActivity(ctx, &entry, test.claimedAt)
+				if test.existing != database.ActivityProcessing {
+					entry.Status = test.existing
+					store.UpdateProcessedActivity(ctx, entry)
+				}
+			}
+
+			err := processActivityOnce(store, ctx, event, database.AthleteSettings{AthleteId: athleteId})
+			if failed := err != nil; failed != test.failed {
+				t.Fatalf("processActivityOnce() got error %v, expected failed %t", err, test.failed)
+			}
+			if err != nil && isPermanent(err) {
+				t.Fatalf("processActivityOnce() got permanent error %s, expected it to be retried", err.Error())
+			}
+			if len(api.updates) != test.updates {
+				t.Fatalf("processActivityOnce() sent %d updates, expected %d", len(api.updates), test.updates)
+			}
+
+			entry, _ := store.GetProcessedActivity(ctx, activityId, "create", 1700000000)
+			if entry.Status != test.status {
+				t.Fatalf("processActivityOnce() recorded status %s, expected %s", entry.Status, test.status)
+			}
+			if entry.TimeToLive == 0 {
+				t.Fatalf("processActivityOnce() recorded %+v, expected a TimeToLive", entry)
+			}
+		})
+	}
+}
+
+func TestProcessRecordsExpiredToken(t *testing.T) {
+	store, api := setup(t, int(time.Now().Add(-time.Hour).Unix()))
+	ctx := context.Background()
+
+	if _, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}")); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+	if api.refreshes != 1 {
+		t.Fatalf("processRecords() refreshed tokens %d times, expected 1", api.refreshes)
+	}
+
+	accessToken, _ := store.GetAccessToken(ctx, athleteId)
+	refreshToken, _ := store.GetRefreshToken(ctx, athleteId)
+	if accessToken.Code != "new-access" || refreshToken.Code != "new-refresh" {
+		t.Fatalf("processRecords() stored tokens %s and %s, expected new-access and new-refresh", accessToken.Code, refreshToken.Code)
+	}
+}
+
+// racingStore simulates another invocation refreshing the athlete's tokens
+// between this invocation reading the refresh token and writing new tokens.
+type racingStore struct {
+	*database.MemoryStore
+}
+
+func (s racingStore) GetRefreshToken(ctx context.Context, athleteId int) (database.RefreshToken, error) {
+	token, err := s.MemoryStore.GetRefreshToken(ctx, athleteId)
+	if err != nil {
+		return token, err
+	}
+	s.MemoryStore.ReplaceTokens(ctx, token,
+		database.AccessToken{AthleteId: athleteId, Code: "other-access", ExpiresAt: 4102444800},
+		database.RefreshToken{AthleteId: athleteId, Code: "other-refresh"},
+	)
+	return token, nil
+}
+
+func TestCheckAccessTokenConcurrentRefresh(t *testing.T) {
+	tests := map[string]struct {
+		tokenStatus int
+	}{
+		"new tokens not stored": {},
+		"refresh token rejected": {
+			tokenStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store, api := setup(t, int(time.Now().Add(-time.Hour).Unix()))
+			api.tokenStatus = test.tokenStatus
+			ctx := context.Background()
+
+			accessToken, _ := store.GetAccessToken(ctx, athleteId)
+			if err := checkAccessToken(racingStore{store}, ctx, &accessToken); err != nil {
+				t.Fatalf("checkAccessToken() got error %s", err.Error())
+			}
+			if accessToken.Code != "other-access" {
+				t.Fatalf("checkAccessToken() used %s, expected other-access", accessToken.Code)
+			}
+
+			storedAccessToken, _ := store.GetAccessToken(ctx, athleteId)
+			refreshToken, _ := store.GetRefreshToken(ctx, athleteId)
+			if storedAccessToken.Code != "other-access" || refreshToken.Code != "other-refresh" {
+				t.Fatalf("checkAccessToken() stored tokens %s and %s, expected other-access and other-refresh", storedAccessToken.Code, refreshToken.Code)
+			}
+		})
+	}
+}
+
+func TestProcessRecordsDeauthorization(t *testing.T) {
+	store, _ := setup(t, int(time.Now().Add(time.Hour).Unix()))
+	ctx := context.Background()
+	store.PutAthleteSettings(ctx, database.AthleteSettings{AthleteId: athleteId, Units: "metric"})
+	store.PutAthleteSettings(ctx, database.AthleteSettings{AthleteId: athleteId + 1, Units: "metric"})
+
+	if _, err := processRecords(store, ctx, createEvent("activity", "create", activityId, "{}")); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+	if _, err := processRecords(store, ctx, createEvent("athlete", "update", athleteId, `{"authorized":"false"}`)); err != nil {
+		t.Fatalf("processRecords() got error %s", err.Error())
+	}
+
+	if _, err := store.GetAccessToken(ctx, athleteId); err == nil {
+		t.Fatal("processRecords() kept the access token")
+	}
+	if _, err := store.GetRefreshToken(ctx, athleteId); err == nil {
+		t.Fatal("processRecords() kept the refresh token")
+	}
+	if settings, _ := store.GetAthleteSettings(ctx, athleteId); settings.Units != "" {
+		t.Fatalf("processRecords() kept the settings %+v", settings)
+	}
+	if stats, _ := store.GetAthleteStats(ctx, athleteId); stats.ActivitiesProcessed != 0 {
+		t.Fatalf("processRecords() kept the stats %+v", stats)
+	}
+	if entry, ok := store.GetProcessedActivity(ctx, activityId, "create", 1700000000); ok {
+		t.Fatalf("processRecords() kept the processed activity %+v", entry)
+	}
+	if settings, _ := store.GetAthleteSettings(ctx, athleteId+1); settings.Units != "metric" {
+		t.Fatalf("processRecords() deleted another athlete's settings %+v", settings)
+	}
+}
+
+func TestProcessRecordsOutcomes(t *testing.T) {
+	tests := map[string]struct {
+		event          events.SQSEvent
+		activity       string
+		activityStatus int
+		settings       database.AthleteSettings
+		failed         bool
+		updates        int
+		status         string
+		outcome        string
+	}{
+		"title update": {
+			event: createEvent("activity", "update", activityId, `{"title":"Renamed"}`),
+		},
+		"location update": {
+			event:   createEvent("activity", "update", activityId, `{"start_latlng":"[41.87,-87.62]"}`),
+			updates: 1,
+			status:  database.ActivityDone,
+		},
+		"title and location update": {
+			event:   createEvent("activity", "update", activityId, `{"title":"Renamed","start_latlng":"[41.87,-87.62]"}`),
+			updates: 1,
+			status:  database.ActivityDone,
+			outcome: "updated",
+		},
+		"description update": {
+			event: createEvent("activity", "update", activityId, `{"description":"Great run"}`),
+		},
+		"malformed body": {
+			event: events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m0", Body: `{"object_type":"activity",`}}},
+		},
+		"wrong field type": {
+			event: events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m0", Body: `{"object_type":"activity","object_id":"5678"}`}}},
+		},
+		"unknown athlete": {
+			event:  events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m0", Body: `{"object_type":"activity","object_id":5678,"aspect_type":"create","owner_id":1,"event_time":1700000000}`}}},
+			status: database.ActivityDone,
+		},
+		"deleted activity": {
+			event:          createEvent("activity", "create", activityId, "{}"),
+			activityStatus: http.StatusNotFound,
+			status:         database.ActivityDone,
+		},
+		"malformed activity": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `<html>Bad gateway</html>`,
+			failed:   true,
+			status:   database.ActivityFailed,
+		},
+		"strava unavailable": {
+			event:          createEvent("activity", "create", activityId, "{}"),
+			activityStatus: http.StatusServiceUnavailable,
+			failed:         true,
+			status:         database.ActivityFailed,
+		},
+		"paused": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			settings: database.AthleteSettings{AthleteId: athleteId, Paused: true},
+			status:   database.ActivityDone,
+			outcome:  "paused",
+		},
+		"activity type disabled": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			settings: database.AthleteSettings{AthleteId: athleteId, ActivityTypes: []string{"Ride"}},
+			status:   database.ActivityDone,
+			outcome:  "activity type disabled",
+		},
+		"activity type enabled": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			settings: database.AthleteSettings{AthleteId: athleteId, ActivityTypes: []string{"Ride", "Run"}},
+			updates:  1,
+			status:   database.ActivityDone,
+			outcome:  "updated",
+		},
+		"trainer activity": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `{"sport_type":"Ride","trainer":true,"start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`,
+			status:   database.ActivityDone,
+			outcome:  "trainer activity",
+		},
+		"trainer activity included": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `{"sport_type":"Ride","trainer":true,"start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`,
+			settings: database.AthleteSettings{AthleteId: athleteId, IncludeTrainer: true},
+			updates:  1,
+			status:   database.ActivityDone,
+			outcome:  "updated",
+		},
+		"virtual activity": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `{"sport_type":"VirtualRide","start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`,
+			status:   database.ActivityDone,
+			outcome:  "virtual activity",
+		},
+		"virtual activity included": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `{"sport_type":"VirtualRide","start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`,
+			settings: database.AthleteSettings{AthleteId: athleteId, IncludeVirtual: true},
+			updates:  1,
+			status:   database.ActivityDone,
+			outcome:  "updated",
+		},
+		"manual activity": {
+			event:    createEvent("activity", "create", activityId, "{}"),
+			activity: `{"sport_type":"Run","manual":true,"start_date":"2023-11-14T14:10:00Z","start_latlng":[41.87,-87.62]}`,
+			status:   database.ActivityDone,
+			outcome:  "manual activity",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store, api := setup(t, int(time.Now().Add(time.Hour).Unix()))
+			api.activityStatus = test.activityStatus
+			if test.activity != "" {
+				api.activity = test.activity
+			}
+			ctx := context.Background()
+			store.PutAthleteSettings(ctx, test.settings)
+
+			resp, err := processRecords(store, ctx, test.event)
+			if err != nil {
+				t.Fatalf("processRecords() got error %s", err.Error())
+			}
+			if failed := len(resp.BatchItemFailures) == 1 && resp.BatchItemFailures[0].ItemIdentifier == "m0"; failed != test.failed {
+				t.Fatalf("processRecords() got failures %+v, expected failed %t", resp.BatchItemFailures, test.failed)
+			}
+			if len(api.updates) != test.updates {
+				t.Fatalf("processRecords() sent %d updates, expected %d", len(api.updates), test.updates)
+			}
+
+			var event webhookEvent
+			json.Unmarshal([]byte(test.event.Records[0].Body), &event)
+			entry, ok := store.GetProcessedActivity(ctx, activityId, event.Aspect_type, event.Event_time)
+			if test.status == "" {
+				if ok {
+					t.Fatalf("processRecords() recorded %+v, expected nothing", entry)
+				}
+				return
+			}
+			if entry.Status != test.status {
+				t.Fatalf("processRecords() recorded status %s, expected %s", entry.Status, test.status)
+			}
+			if test.outcome != "" && entry.Outcome != test.outcome {
+				t.Fatalf("processRecords() recorded outcome %q, expected %q", entry.Outcome, test.outcome)
+			}
+		})
+	}
+}
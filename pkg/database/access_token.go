@@ -1,16 +1,17 @@
 package database
 
 import (
-	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type AccessToken struct {
-	AthleteId int    `dynamodbav:"AthleteId"`
-	Code      string `dynamodbav:"AccessToken"`
-	ExpiresAt int    `dynamodbav:"ExpiresAt"`
+	AthleteId         int    `dynamodbav:"AthleteId"`
+	Code              string `dynamodbav:"AccessToken"`
+	ExpiresAt         int    `dynamodbav:"ExpiresAt"`
+	Scope             string `dynamodbav:"Scope,omitempty"`
+	InsufficientScope bool   `dynamodbav:"InsufficientScope,omitempty"`
 }
 
 func (a AccessToken) IsExpired() bool {
@@ -18,7 +19,5 @@ func (a AccessToken) IsExpired() bool {
 }
 
 func (a AccessToken) GetKey() map[string]types.AttributeValue {
-	return map[string]types.AttributeValue{
-		"AthleteId": &types.AttributeValueMemberN{Value: strconv.Itoa(a.AthleteId)},
-	}
+	return athleteKey(a.AthleteId, tokenSortKey)
 }
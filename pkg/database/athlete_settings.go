@@ -0,0 +1,45 @@
+package database
+
+import (
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const measurementPreferenceTTL = 7 * 24 * time.Hour
+
+// AthleteSettings holds an athlete's preferences. The zero value of each field
+// is the default: units follow the athlete's Strava measurement preference,
+// the default template is used in English with emoji, every activity type is
+// processed except trainer, virtual and manual activities, and processing is
+// not paused.
+type AthleteSettings struct {
+	AthleteId                      int      `dynamodbav:"AthleteId"`
+	Units                          string   `dynamodbav:"Units,omitempty"`
+	Template                       string   `dynamodbav:"Template,omitempty"`
+	Prepend                        bool     `dynamodbav:"Prepend,omitempty"`
+	Language                       string   `dynamodbav:"Language,omitempty"`
+	ActivityTypes                  []string `dynamodbav:"ActivityTypes,omitempty"`
+	HideEmoji                      bool     `dynamodbav:"HideEmoji,omitempty"`
+	Paused                         bool     `dynamodbav:"Paused,omitempty"`
+	IncludeTrainer                 bool     `dynamodbav:"IncludeTrainer,omitempty"`
+	IncludeVirtual                 bool     `dynamodbav:"IncludeVirtual,omitempty"`
+	IncludeManual                  bool     `dynamodbav:"IncludeManual,omitempty"`
+	MeasurementPreference          string   `dynamodbav:"MeasurementPreference,omitempty"`
+	MeasurementPreferenceCheckedAt int      `dynamodbav:"MeasurementPreferenceCheckedAt,omitempty"`
+}
+
+// IsActivityTypeEnabled reports whether activities of the Strava sport type
+// should get the weather. An empty ActivityTypes enables every type.
+func (s AthleteSettings) IsActivityTypeEnabled(sportType string) bool {
+	return len(s.ActivityTypes) == 0 || slices.Contains(s.ActivityTypes, sportType)
+}
+
+func (s AthleteSettings) IsMeasurementPreferenceExpired() bool {
+	return time.Since(time.Unix(int64(s.MeasurementPreferenceCheckedAt), 0)) >= measurementPreferenceTTL
+}
+
+func (s AthleteSettings) GetKey() map[string]types.AttributeValue {
+	return athleteKey(s.AthleteId, settingsSortKey)
+}
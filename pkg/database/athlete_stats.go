@@ -0,0 +1,15 @@
+package database
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type AthleteStats struct {
+	AthleteId           int `dynamodbav:"AthleteId"`
+	ActivitiesProcessed int `dynamodbav:"ActivitiesProcessed"`
+	LastProcessedAt     int `dynamodbav:"LastProcessedAt"`
+}
+
+func (s AthleteStats) GetKey() map[string]types.AttributeValue {
+	return athleteKey(s.AthleteId, statsSortKey)
+}
@@ -2,7 +2,10 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -20,37 +23,374 @@ func (e *DatabaseError) Error() string {
 	return fmt.Sprintf("Athlete id %v not found", e.id)
 }
 
+// CreateDatabaseError returns the error for an athlete that is not stored.
+func CreateDatabaseError(athleteId int) *DatabaseError {
+	return &DatabaseError{athleteKey(athleteId, "")["AthleteId"]}
+}
+
 type DynamoDBClient struct {
-	svc *dynamodb.Client
+	svc      *dynamodb.Client
+	table    string
+	envelope *Envelope
 }
 
 func (c DynamoDBClient) GetAccessToken(ctx context.Context, athleteId int) (AccessToken, error) {
 	token := AccessToken{AthleteId: athleteId}
-	err := c.getItem(ctx, token.GetKey(), "AccessTokens", &token)
+	if err := c.getItem(ctx, token.GetKey(), &token); err != nil {
+		return token, err
+	}
+	if token.Code == "" {
+		return token, &DatabaseError{token.GetKey()["AthleteId"]}
+	}
+
+	var err error
+	token.Code, err = c.envelope.Decrypt(ctx, athleteId, AccessTokenAttribute, token.Code)
 	return token, err
 }
 
 func (c DynamoDBClient) UpdateAccessToken(ctx context.Context, token AccessToken) error {
-	update := expression.Set(expression.Name("AccessToken"), expression.Value(token.Code))
+	code, err := c.envelope.Encrypt(ctx, token.AthleteId, AccessTokenAttribute, token.Code)
+	if err != nil {
+		return err
+	}
+
+	update := expression.Set(expression.Name("AccessToken"), expression.Value(code))
 	update.Set(expression.Name("ExpiresAt"), expression.Value(token.ExpiresAt))
-	return c.updateItem(ctx, token.GetKey(), "AccessTokens", update)
+	if token.Scope != "" {
+		update.Set(expression.Name("Scope"), expression.Value(token.Scope))
+		update.Remove(expression.Name("InsufficientScope"))
+	}
+	return c.updateItem(ctx, token.GetKey(), update)
+}
+
+func (c DynamoDBClient) FlagInsufficientScope(ctx context.Context, token AccessToken) error {
+	update := expression.Set(expression.Name("InsufficientScope"), expression.Value(true))
+	return c.updateItem(ctx, token.GetKey(), update)
 }
 
 func (c DynamoDBClient) GetRefreshToken(ctx context.Context, athleteId int) (RefreshToken, error) {
 	token := RefreshToken{AthleteId: athleteId}
-	err := c.getItem(ctx, token.GetKey(), "RefreshTokens", &token)
+	if err := c.getItem(ctx, token.GetKey(), &token); err != nil {
+		return token, err
+	}
+	if token.Code == "" {
+		return token, &DatabaseError{token.GetKey()["AthleteId"]}
+	}
+
+	var err error
+	token.stored = token.Code
+	token.Code, err = c.envelope.Decrypt(ctx, athleteId, RefreshTokenAttribute, token.Code)
 	return token, err
 }
 
 func (c DynamoDBClient) UpdateRefreshToken(ctx context.Context, token RefreshToken) error {
-	update := expression.Set(expression.Name("RefreshToken"), expression.Value(token.Code))
-	return c.updateItem(ctx, token.GetKey(), "RefreshTokens", update)
+	code, err := c.envelope.Encrypt(ctx, token.AthleteId, RefreshTokenAttribute, token.Code)
+	if err != nil {
+		return err
+	}
+
+	update := expression.Set(expression.Name("RefreshToken"), expression.Value(code))
+	return c.updateItem(ctx, token.GetKey(), update)
+}
+
+// ReplaceTokens stores tokens obtained with the previous refresh token. It
+// returns false without writing anything if the stored refresh token is no
+// longer previous, which means another invocation has already refreshed.
+func (c DynamoDBClient) ReplaceTokens(ctx context.Context, previous RefreshToken, accessToken AccessToken, refreshToken RefreshToken) (bool, error) {
+	accessCode, err := c.envelope.Encrypt(ctx, accessToken.AthleteId, AccessTokenAttribute, accessToken.Code)
+	if err != nil {
+		return false, err
+	}
+	refreshCode, err := c.envelope.Encrypt(ctx, refreshToken.AthleteId, RefreshTokenAttribute, refreshToken.Code)
+	if err != nil {
+		return false, err
+	}
+
+	// Both tokens live on the TOKEN item, so a single conditional update
+	// replaces them together.
+	update := expression.Set(expression.Name("AccessToken"), expression.Value(accessCode))
+	update.Set(expression.Name("ExpiresAt"), expression.Value(accessToken.ExpiresAt))
+	update.Set(expression.Name("RefreshToken"), expression.Value(refreshCode))
+	condition := expression.Name("RefreshToken").Equal(expression.Value(previous.StoredCode()))
+
+	err = c.updateItemWithCondition(ctx, refreshToken.GetKey(), update, &condition)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c DynamoDBClient) GetAthleteSettings(ctx context.Context, athleteId int) (AthleteSettings, error) {
+	settings := AthleteSettings{AthleteId: athleteId}
+	err := c.getItem(ctx, settings.GetKey(), &settings)
+
+	var de *DatabaseError
+	if errors.As(err, &de) {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// PutAthleteSettings saves the preferences in settings. The cached
+// measurement preference is left alone.
+func (c DynamoDBClient) PutAthleteSettings(ctx context.Context, settings AthleteSettings) error {
+	var update expression.UpdateBuilder
+	update = setOrRemove(update, "Units", settings.Units, settings.Units == "")
+	update = setOrRemove(update, "Template", settings.Template, settings.Template == "")
+	update = setOrRemove(update, "Prepend", settings.Prepend, !settings.Prepend)
+	update = setOrRemove(update, "Language", settings.Language, settings.Language == "")
+	update = setOrRemove(update, "ActivityTypes", settings.ActivityTypes, len(settings.ActivityTypes) == 0)
+	update = setOrRemove(update, "HideEmoji", settings.HideEmoji, !settings.HideEmoji)
+	update = setOrRemove(update, "Paused", settings.Paused, !settings.Paused)
+	update = setOrRemove(update, "IncludeTrainer", settings.IncludeTrainer, !settings.IncludeTrainer)
+	update = setOrRemove(update, "IncludeVirtual", settings.IncludeVirtual, !settings.IncludeVirtual)
+	update = setOrRemove(update, "IncludeManual", settings.IncludeManual, !settings.IncludeManual)
+	return c.updateItem(ctx, settings.GetKey(), update)
+}
+
+func (c DynamoDBClient) UpdateMeasurementPreference(ctx context.Context, settings AthleteSettings) error {
+	update := expression.Set(expression.Name("MeasurementPreference"), expression.Value(settings.MeasurementPreference))
+	update.Set(expression.Name("MeasurementPreferenceCheckedAt"), expression.Value(settings.MeasurementPreferenceCheckedAt))
+	return c.updateItem(ctx, settings.GetKey(), update)
 }
 
-func (c DynamoDBClient) getItem(ctx context.Context, key map[string]types.AttributeValue, tableName string, out any) error {
+// DeleteAthlete deletes every item in the athlete's partition: tokens,
+// settings, stats and processed activities.
+func (c DynamoDBClient) DeleteAthlete(ctx context.Context, athleteId int) error {
+	keyCondition := expression.Key("AthleteId").Equal(expression.Value(athleteId))
+	projection := expression.NamesList(expression.Name("AthleteId"), expression.Name("SortKey"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).WithProjection(projection).Build()
+	if err != nil {
+		return err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(c.svc, &dynamodb.QueryInput{
+		TableName:                 aws.String(c.table),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		// BatchWriteItem accepts at most 25 requests.
+		for items := range slices.Chunk(page.Items, 25) {
+			requests := make([]types.WriteRequest, len(items))
+			for i, item := range items {
+				requests[i] = types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: item}}
+			}
+			if err = c.batchWrite(ctx, requests); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c DynamoDBClient) GetAthleteStats(ctx context.Context, athleteId int) (AthleteStats, error) {
+	stats := AthleteStats{AthleteId: athleteId}
+	err := c.getItem(ctx, stats.GetKey(), &stats)
+
+	var de *DatabaseError
+	if errors.As(err, &de) {
+		return stats, nil
+	}
+	return stats, err
+}
+
+func (c DynamoDBClient) GetRateLimitUsage(ctx context.Context) (RateLimitUsage, error) {
+	usage := RateLimitUsage{Id: "strava"}
+	err := c.getItem(ctx, usage.GetKey(), &usage)
+
+	var de *DatabaseError
+	if errors.As(err, &de) {
+		return usage, nil
+	}
+	return usage, err
+}
+
+func (c DynamoDBClient) UpdateRateLimitUsage(ctx context.Context, usage RateLimitUsage) error {
+	usage.Id = "strava"
+	update := expression.Set(expression.Name("ShortLimit"), expression.Value(usage.ShortLimit))
+	update.Set(expression.Name("ShortUsage"), expression.Value(usage.ShortUsage))
+	update.Set(expression.Name("DailyLimit"), expression.Value(usage.DailyLimit))
+	update.Set(expression.Name("DailyUsage"), expression.Value(usage.DailyUsage))
+	update.Set(expression.Name("UpdatedAt"), expression.Value(usage.UpdatedAt))
+
+	// Concurrent invocations may finish out of order, so never replace newer
+	// usage with older usage.
+	condition := expression.Or(
+		expression.AttributeNotExists(expression.Name("UpdatedAt")),
+		expression.Name("UpdatedAt").LessThanEqual(expression.Value(usage.UpdatedAt)),
+	)
+
+	err := c.updateItemWithCondition(ctx, usage.GetKey(), update, &condition)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
+
+// ClaimProcessedActivity marks the event as being processed. It returns false
+// and loads the existing entry into activity if the event has already been
+// processed or another invocation is still working on it.
+func (c DynamoDBClient) ClaimProcessedActivity(ctx context.Context, activity *ProcessedActivity, now time.Time) (bool, error) {
+	activity.Status = ActivityProcessing
+	activity.ClaimedAt = int(now.Unix())
+	activity.TimeToLive = int(now.Add(processedActivityRetention).Unix())
+
+	update := expression.Set(expression.Name("ActivityId"), expression.Value(activity.ActivityId))
+	update.Set(expression.Name("Aspect"), expression.Value(activity.Aspect))
+	update.Set(expression.Name("EventTime"), expression.Value(activity.EventTime))
+	update.Set(expression.Name("Status"), expression.Value(activity.Status))
+	update.Set(expression.Name("ClaimedAt"), expression.Value(activity.ClaimedAt))
+	update.Set(expression.Name("TimeToLive"), expression.Value(activity.TimeToLive))
+
+	condition := expression.Or(
+		expression.AttributeNotExists(expression.Name("Status")),
+		expression.Name("Status").Equal(expression.Value(ActivityFailed)),
+		expression.And(
+			expression.Name("Status").Equal(expression.Value(ActivityProcessing)),
+			expression.Name("ClaimedAt").LessThan(expression.Value(now.Add(-processingLease).Unix())),
+		),
+	)
+
+	err := c.updateItemWithCondition(ctx, activity.GetKey(), update, &condition)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, attributevalue.UnmarshalMap(ccf.Item, activity)
+	}
+	return err == nil, err
+}
+
+// UpdateProcessedActivity records the outcome of the event. Finished events
+// are also counted on the athlete's STATS item in the same transaction.
+func (c DynamoDBClient) UpdateProcessedActivity(ctx context.Context, activity ProcessedActivity) error {
+	update := expression.Set(expression.Name("Status"), expression.Value(activity.Status))
+	update.Set(expression.Name("Outcome"), expression.Value(activity.Outcome))
+	update.Set(expression.Name("ProcessedAt"), expression.Value(activity.ProcessedAt))
+	if activity.Provider != "" {
+		update.Set(expression.Name("Provider"), expression.Value(activity.Provider))
+	}
+	if activity.Status != ActivityDone {
+		return c.updateItem(ctx, activity.GetKey(), update)
+	}
+
+	activityUpdate, err := c.transactUpdate(activity.GetKey(), update)
+	if err != nil {
+		return err
+	}
+
+	stats := AthleteStats{AthleteId: activity.AthleteId}
+	statsUpdate := expression.Add(expression.Name("ActivitiesProcessed"), expression.Value(1))
+	statsUpdate.Set(expression.Name("LastProcessedAt"), expression.Value(activity.ProcessedAt))
+	statsTransactUpdate, err := c.transactUpdate(stats.GetKey(), statsUpdate)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.svc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{{Update: activityUpdate}, {Update: statsTransactUpdate}},
+	})
+	return err
+}
+
+// ReencryptTokens encrypts every stored token that is in plain text or was
+// encrypted with an old key using the current key, and returns the number of
+// tokens rewritten.
+func (c DynamoDBClient) ReencryptTokens(ctx context.Context) (int, error) {
+	if c.envelope == nil {
+		return 0, ErrEncryptionNotConfigured
+	}
+
+	count := 0
+	filter, err := expression.NewBuilder().WithFilter(
+		expression.Name("SortKey").Equal(expression.Value(tokenSortKey)),
+	).Build()
+	if err != nil {
+		return count, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(c.svc, &dynamodb.ScanInput{
+		TableName:                 aws.String(c.table),
+		ExpressionAttributeNames:  filter.Names(),
+		ExpressionAttributeValues: filter.Values(),
+		FilterExpression:          filter.Filter(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return count, err
+		}
+
+		for _, item := range page.Items {
+			for _, attribute := range []string{AccessTokenAttribute, RefreshTokenAttribute} {
+				rewritten, err := c.reencryptAttribute(ctx, item, attribute)
+				if err != nil {
+					return count, err
+				}
+				if rewritten {
+					count++
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+func (c DynamoDBClient) reencryptAttribute(ctx context.Context, item map[string]types.AttributeValue, attribute string) (bool, error) {
+	value, ok := item[attribute].(*types.AttributeValueMemberS)
+	if !ok || !c.envelope.NeedsRotation(value.Value) {
+		return false, nil
+	}
+
+	var athleteId int
+	if err := attributevalue.Unmarshal(item["AthleteId"], &athleteId); err != nil {
+		return false, err
+	}
+
+	plaintext, err := c.envelope.Decrypt(ctx, athleteId, attribute, value.Value)
+	if err != nil {
+		return false, err
+	}
+	code, err := c.envelope.Encrypt(ctx, athleteId, attribute, plaintext)
+	if err != nil {
+		return false, err
+	}
+
+	// A token refreshed since the scan is already encrypted with the current
+	// key and must not be overwritten.
+	update := expression.Set(expression.Name(attribute), expression.Value(code))
+	condition := expression.Name(attribute).Equal(expression.Value(value.Value))
+	key := map[string]types.AttributeValue{"AthleteId": item["AthleteId"], "SortKey": item["SortKey"]}
+
+	err = c.updateItemWithCondition(ctx, key, update, &condition)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setOrRemove sets the attribute, or removes it when value is empty so that
+// reads fall back to the default.
+func setOrRemove(update expression.UpdateBuilder, name string, value any, empty bool) expression.UpdateBuilder {
+	if empty {
+		return update.Remove(expression.Name(name))
+	}
+	return update.Set(expression.Name(name), expression.Value(value))
+}
+
+func (c DynamoDBClient) getItem(ctx context.Context, key map[string]types.AttributeValue, out any) error {
 	resp, err := c.svc.GetItem(ctx, &dynamodb.GetItemInput{
 		Key:       key,
-		TableName: aws.String(tableName),
+		TableName: aws.String(c.table),
 	})
 	if err != nil {
 		return err
@@ -63,20 +403,69 @@ func (c DynamoDBClient) getItem(ctx context.Context, key map[string]types.Attrib
 	return attributevalue.UnmarshalMap(resp.Item, out)
 }
 
-func (c DynamoDBClient) updateItem(ctx context.Context, key map[string]types.AttributeValue, tableName string, update expression.UpdateBuilder) error {
-	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+func (c DynamoDBClient) updateItem(ctx context.Context, key map[string]types.AttributeValue, update expression.UpdateBuilder) error {
+	return c.updateItemWithCondition(ctx, key, update, nil)
+}
+
+func (c DynamoDBClient) updateItemWithCondition(ctx context.Context, key map[string]types.AttributeValue, update expression.UpdateBuilder, condition *expression.ConditionBuilder) error {
+	builder := expression.NewBuilder().WithUpdate(update)
+	if condition != nil {
+		builder = builder.WithCondition(*condition)
+	}
+
+	expr, err := builder.Build()
 	if err != nil {
 		return err
 	}
 
 	_, err = c.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key:                                 key,
+		TableName:                           aws.String(c.table),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	return err
+}
+
+func (c DynamoDBClient) transactUpdate(key map[string]types.AttributeValue, update expression.UpdateBuilder) (*types.Update, error) {
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Update{
 		Key:                       key,
-		TableName:                 aws.String(tableName),
+		TableName:                 aws.String(c.table),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
-	})
-	return err
+	}, nil
+}
+
+// batchWrite retries unprocessed requests with a growing delay until they
+// have all been written.
+func (c DynamoDBClient) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+
+		resp, err := c.svc.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{c.table: requests},
+		})
+		if err != nil {
+			return err
+		}
+		requests = resp.UnprocessedItems[c.table]
+	}
+	return nil
 }
 
 func CreateClient(ctx context.Context) (DynamoDBClient, error) {
@@ -84,5 +473,10 @@ func CreateClient(ctx context.Context) (DynamoDBClient, error) {
 	if err != nil {
 		return DynamoDBClient{}, err
 	}
-	return DynamoDBClient{dynamodb.NewFromConfig(cfg)}, nil
+
+	envelope, err := CreateEnvelopeFromEnv(ctx)
+	if err != nil {
+		return DynamoDBClient{}, err
+	}
+	return DynamoDBClient{dynamodb.NewFromConfig(cfg), getTableName(), envelope}, nil
 }
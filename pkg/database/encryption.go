@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Encrypted values look like enc2.<key id>.<wrapped data key>.<nonce and
+// ciphertext>, with each part base64 encoded. The athlete ID and attribute
+// name are bound to the ciphertext as associated data, so a value copied to
+// another athlete or attribute fails to decrypt. Values without the prefix
+// were written before encryption was enabled and are returned unchanged.
+const encryptedPrefix = "enc2."
+
+// Attribute names bound to encrypted tokens. Every store uses these names,
+// whatever its own column names are.
+const (
+	AccessTokenAttribute  = "AccessToken"
+	RefreshTokenAttribute = "RefreshToken"
+)
+
+var encoding = base64.RawURLEncoding
+
+// KeyProvider wraps and unwraps the data keys that encrypt each token. New
+// data keys are wrapped with the key named by KeyId, and old keys remain
+// available for unwrapping until every value has been re-encrypted.
+type KeyProvider interface {
+	KeyId() string
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+}
+
+type EncryptionError struct {
+	message string
+}
+
+func (e *EncryptionError) Error() string {
+	return e.message
+}
+
+var ErrEncryptionNotConfigured = &EncryptionError{"Token encryption is not configured"}
+
+// Envelope encrypts token values with a random data key per value, and stores
+// the data key wrapped by a KeyProvider alongside the ciphertext. A nil
+// Envelope stores values in plain text.
+type Envelope struct {
+	keys KeyProvider
+}
+
+func (e *Envelope) Encrypt(ctx context.Context, athleteId int, attribute string, plaintext string) (string, error) {
+	if e == nil {
+		return plaintext, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(key, []byte(plaintext), associatedData(athleteId, attribute))
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := e.keys.WrapKey(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + strings.Join([]string{
+		encoding.EncodeToString([]byte(e.keys.KeyId())),
+		encoding.EncodeToString(wrapped),
+		encoding.EncodeToString(sealed),
+	}, "."), nil
+}
+
+func (e *Envelope) Decrypt(ctx context.Context, athleteId int, attribute string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if e == nil {
+		return "", &EncryptionError{"Token is encrypted but no key provider is configured"}
+	}
+
+	keyId, wrapped, sealed, err := parseEncrypted(value)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := e.keys.UnwrapKey(ctx, keyId, wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := unseal(key, sealed, associatedData(athleteId, attribute))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether value is in plain text or was encrypted with a
+// key other than the current one.
+func (e *Envelope) NeedsRotation(value string) bool {
+	if e == nil {
+		return false
+	}
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return true
+	}
+
+	keyId, _, _, err := parseEncrypted(value)
+	return err != nil || keyId != e.keys.KeyId()
+}
+
+func associatedData(athleteId int, attribute string) []byte {
+	return []byte(strconv.Itoa(athleteId) + "/" + attribute)
+}
+
+func parseEncrypted(value string) (string, []byte, []byte, error) {
+	value = strings.TrimPrefix(value, encryptedPrefix)
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", nil, nil, &EncryptionError{"Malformed encrypted token"}
+	}
+
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		b, err := encoding.DecodeString(part)
+		if err != nil {
+			return "", nil, nil, &EncryptionError{"Malformed encrypted token"}
+		}
+		decoded[i] = b
+	}
+	return string(decoded[0]), decoded[1], decoded[2], nil
+}
+
+// seal encrypts plaintext with AES-GCM, authenticating aad alongside it, and
+// prepends the random nonce.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, &EncryptionError{"Malformed encrypted token"}
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, &EncryptionError{"Token could not be decrypted"}
+	}
+	return plaintext, nil
+}
+
+func CreateEnvelope(keys KeyProvider) *Envelope {
+	return &Envelope{keys}
+}
+
+// CreateEnvelopeFromEnv uses the KMS key in TOKEN_KMS_KEY_ID or the keyfile
+// in TOKEN_KEY_FILE. If neither is set, tokens are stored in plain text.
+func CreateEnvelopeFromEnv(ctx context.Context) (*Envelope, error) {
+	kmsKeyId, keyPath := os.Getenv("TOKEN_KMS_KEY_ID"), os.Getenv("TOKEN_KEY_FILE")
+	switch {
+	case kmsKeyId != "" && keyPath != "":
+		return nil, errors.New("only one of TOKEN_KMS_KEY_ID and TOKEN_KEY_FILE may be set")
+
+	case kmsKeyId != "":
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return CreateEnvelope(CreateKMSKeyProvider(cfg, kmsKeyId)), nil
+
+	case keyPath != "":
+		keys, err := CreateLocalKeyProvider(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", keyPath, err)
+		}
+		return CreateEnvelope(keys), nil
+	}
+
+	return nil, nil
+}
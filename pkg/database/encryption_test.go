@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, current string, ids ...string) string {
+	keys := []string{}
+	for i, id := range ids {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32)))
+		keys = append(keys, `"`+id+`":"`+key+`"`)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	contents := `{"current":"` + current + `","keys":{` + strings.Join(keys, ",") + `}}`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func createTestEnvelope(t *testing.T, current string, ids ...string) *Envelope {
+	keys, err := CreateLocalKeyProvider(writeKeyFile(t, current, ids...))
+	if err != nil {
+		t.Fatalf("CreateLocalKeyProvider() got error %s", err.Error())
+	}
+	return CreateEnvelope(keys)
+}
+
+func TestEnvelope(t *testing.T) {
+	ctx := context.Background()
+	old := createTestEnvelope(t, "k1", "k1", "k2")
+	current := createTestEnvelope(t, "k2", "k1", "k2")
+
+	encrypted, err := old.Encrypt(ctx, 1, AccessTokenAttribute, "secret")
+	if err != nil {
+		t.Fatalf("Encrypt() got error %s", err.Error())
+	}
+	if !strings.HasPrefix(encrypted, encryptedPrefix) || strings.Contains(encrypted, "secret") {
+		t.Fatalf("Encrypt() got %s, expected an encrypted value", encrypted)
+	}
+
+	tests := map[string]struct {
+		envelope  *Envelope
+		value     string
+		athleteId int
+		attribute string
+		result    string
+		rotate    bool
+		err       bool
+	}{
+		"plain text": {
+			envelope: current,
+			value:    "secret",
+			result:   "secret",
+			rotate:   true,
+		},
+		"old key": {
+			envelope: current,
+			value:    encrypted,
+			result:   "secret",
+			rotate:   true,
+		},
+		"current key": {
+			envelope: old,
+			value:    encrypted,
+			result:   "secret",
+			rotate:   false,
+		},
+		"unknown key": {
+			envelope: createTestEnvelope(t, "k2", "k2"),
+			value:    encrypted,
+			rotate:   true,
+			err:      true,
+		},
+		"other athlete": {
+			envelope:  old,
+			value:     encrypted,
+			athleteId: 2,
+			err:       true,
+		},
+		"other attribute": {
+			envelope:  old,
+			value:     encrypted,
+			attribute: RefreshTokenAttribute,
+			err:       true,
+		},
+		"no key provider": {
+			value: encrypted,
+			err:   true,
+		},
+		"malformed": {
+			envelope: current,
+			value:    encryptedPrefix + "abc",
+			rotate:   true,
+			err:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			athleteId, attribute := 1, AccessTokenAttribute
+			if test.athleteId != 0 {
+				athleteId = test.athleteId
+			}
+			if test.attribute != "" {
+				attribute = test.attribute
+			}
+
+			result, err := test.envelope.Decrypt(ctx, athleteId, attribute, test.value)
+			if test.err {
+				var ee *EncryptionError
+				if !errors.As(err, &ee) {
+					t.Fatalf("Decrypt() got error %v, expected EncryptionError", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Decrypt() got error %s", err.Error())
+			} else if result != test.result {
+				t.Fatalf("Decrypt() got %s, expected %s", result, test.result)
+			}
+
+			if rotate := test.envelope.NeedsRotation(test.value); rotate != test.rotate {
+				t.Fatalf("NeedsRotation() got %t, expected %t", rotate, test.rotate)
+			}
+		})
+	}
+}
+
+func TestCreateLocalKeyProvider(t *testing.T) {
+	if _, err := CreateLocalKeyProvider(writeKeyFile(t, "k2", "k1")); err == nil {
+		t.Fatal("CreateLocalKeyProvider() with a missing current key got no error")
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`{"current":"k1","keys":{"k1":"c2hvcnQ="}}`), 0600)
+	if _, err := CreateLocalKeyProvider(path); err == nil {
+		t.Fatal("CreateLocalKeyProvider() with a short key got no error")
+	}
+}
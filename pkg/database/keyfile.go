@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+)
+
+// LocalKeyProvider wraps data keys with AES-256 keys read from a JSON keyfile
+// such as
+//
+//	{"current": "2024-06", "keys": {"2024-01": "<base64>", "2024-06": "<base64>"}}
+//
+// To rotate, add a key, make it current and re-encrypt the stored tokens
+// before removing the old key.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+func (p LocalKeyProvider) KeyId() string {
+	return p.current
+}
+
+func (p LocalKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	return seal(p.keys[p.current], key, nil)
+}
+
+func (p LocalKeyProvider) UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyId]
+	if !ok {
+		return nil, &EncryptionError{"Unknown key " + keyId}
+	}
+	return unseal(key, wrapped, nil)
+}
+
+func CreateLocalKeyProvider(path string) (LocalKeyProvider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return LocalKeyProvider{}, err
+	}
+
+	var file keyFile
+	if err = json.Unmarshal(b, &file); err != nil {
+		return LocalKeyProvider{}, err
+	}
+
+	provider := LocalKeyProvider{current: file.Current, keys: map[string][]byte{}}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return LocalKeyProvider{}, &EncryptionError{"Key " + id + " is not a base64 encoded 32-byte key"}
+		}
+		provider.keys[id] = key
+	}
+
+	if _, ok := provider.keys[provider.current]; !ok {
+		return LocalKeyProvider{}, &EncryptionError{"Current key " + provider.current + " not found"}
+	}
+	return provider, nil
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KMSKeyProvider wraps data keys with an AWS KMS key. After rotating to a new
+// key, the old key must stay enabled until the stored tokens are re-encrypted.
+// The key ID is compared as configured, so repointing an alias is not seen as
+// a rotation.
+type KMSKeyProvider struct {
+	svc   *kms.Client
+	keyId string
+}
+
+func (p KMSKeyProvider) KeyId() string {
+	return p.keyId
+}
+
+func (p KMSKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := p.svc.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(p.keyId),
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
+
+func (p KMSKeyProvider) UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	resp, err := p.svc.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyId),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func CreateKMSKeyProvider(cfg aws.Config, keyId string) KMSKeyProvider {
+	return KMSKeyProvider{kms.NewFromConfig(cfg), keyId}
+}
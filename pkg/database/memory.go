@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type processedActivityKey struct {
+	activityId int
+	aspect     string
+	eventTime  int
+}
+
+type MemoryStore struct {
+	mu                  sync.Mutex
+	accessTokens        map[int]AccessToken
+	refreshTokens       map[int]RefreshToken
+	athleteSettings     map[int]AthleteSettings
+	athleteStats        map[int]AthleteStats
+	rateLimitUsage      RateLimitUsage
+	processedActivities map[processedActivityKey]ProcessedActivity
+}
+
+func (s *MemoryStore) GetAccessToken(ctx context.Context, athleteId int) (AccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.accessTokens[athleteId]
+	if !ok {
+		token = AccessToken{AthleteId: athleteId}
+		return token, &DatabaseError{token.GetKey()["AthleteId"]}
+	}
+	return token, nil
+}
+
+func (s *MemoryStore) UpdateAccessToken(ctx context.Context, token AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.accessTokens[token.AthleteId]
+	existing.AthleteId = token.AthleteId
+	existing.Code = token.Code
+	existing.ExpiresAt = token.ExpiresAt
+	if token.Scope != "" {
+		existing.Scope = token.Scope
+		existing.InsufficientScope = false
+	}
+	s.accessTokens[token.AthleteId] = existing
+	return nil
+}
+
+func (s *MemoryStore) FlagInsufficientScope(ctx context.Context, token AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.accessTokens[token.AthleteId]
+	existing.AthleteId = token.AthleteId
+	existing.InsufficientScope = true
+	s.accessTokens[token.AthleteId] = existing
+	return nil
+}
+
+func (s *MemoryStore) GetRefreshToken(ctx context.Context, athleteId int) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refreshTokens[athleteId]
+	if !ok {
+		token = RefreshToken{AthleteId: athleteId}
+		return token, &DatabaseError{token.GetKey()["AthleteId"]}
+	}
+	return token, nil
+}
+
+func (s *MemoryStore) UpdateRefreshToken(ctx context.Context, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refreshTokens[token.AthleteId] = token
+	return nil
+}
+
+func (s *MemoryStore) ReplaceTokens(ctx context.Context, previous RefreshToken, accessToken AccessToken, refreshToken RefreshToken) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.refreshTokens[previous.AthleteId]; !ok || existing.Code != previous.Code {
+		return false, nil
+	}
+
+	existing := s.accessTokens[accessToken.AthleteId]
+	existing.AthleteId = accessToken.AthleteId
+	existing.Code = accessToken.Code
+	existing.ExpiresAt = accessToken.ExpiresAt
+	s.accessTokens[accessToken.AthleteId] = existing
+	s.refreshTokens[refreshToken.AthleteId] = refreshToken
+	return true, nil
+}
+
+func (s *MemoryStore) GetAthleteSettings(ctx context.Context, athleteId int) (AthleteSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings, ok := s.athleteSettings[athleteId]
+	if !ok {
+		settings = AthleteSettings{AthleteId: athleteId}
+	}
+	return settings, nil
+}
+
+func (s *MemoryStore) PutAthleteSettings(ctx context.Context, settings AthleteSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.athleteSettings[settings.AthleteId]
+	settings.MeasurementPreference = existing.MeasurementPreference
+	settings.MeasurementPreferenceCheckedAt = existing.MeasurementPreferenceCheckedAt
+	s.athleteSettings[settings.AthleteId] = settings
+	return nil
+}
+
+func (s *MemoryStore) UpdateMeasurementPreference(ctx context.Context, settings AthleteSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.athleteSettings[settings.AthleteId]
+	existing.AthleteId = settings.AthleteId
+	existing.MeasurementPreference = settings.MeasurementPreference
+	existing.MeasurementPreferenceCheckedAt = settings.MeasurementPreferenceCheckedAt
+	s.athleteSettings[settings.AthleteId] = existing
+	return nil
+}
+
+func (s *MemoryStore) DeleteAthlete(ctx context.Context, athleteId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.accessTokens, athleteId)
+	delete(s.refreshTokens, athleteId)
+	delete(s.athleteSettings, athleteId)
+	delete(s.athleteStats, athleteId)
+	for key, activity := range s.processedActivities {
+		if activity.AthleteId == athleteId {
+			delete(s.processedActivities, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetAthleteStats(ctx context.Context, athleteId int) (AthleteStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.athleteStats[athleteId]
+	stats.AthleteId = athleteId
+	return stats, nil
+}
+
+func (s *MemoryStore) GetRateLimitUsage(ctx context.Context) (RateLimitUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.rateLimitUsage
+	usage.Id = "strava"
+	return usage, nil
+}
+
+func (s *MemoryStore) UpdateRateLimitUsage(ctx context.Context, usage RateLimitUsage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usage.UpdatedAt >= s.rateLimitUsage.UpdatedAt {
+		usage.Id = "strava"
+		s.rateLimitUsage = usage
+	}
+	return nil
+}
+
+func (s *MemoryStore) ClaimProcessedActivity(ctx context.Context, activity *ProcessedActivity, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := processedActivityKey{activity.ActivityId, activity.Aspect, activity.EventTime}
+	if existing, ok := s.processedActivities[key]; ok {
+		expired := existing.Status == ActivityProcessing && int64(existing.ClaimedAt) < now.Add(-processingLease).Unix()
+		if existing.Status != ActivityFailed && !expired {
+			*activity = existing
+			return false, nil
+		}
+	}
+
+	activity.Status = ActivityProcessing
+	activity.ClaimedAt = int(now.Unix())
+	activity.TimeToLive = int(now.Add(processedActivityRetention).Unix())
+	s.processedActivities[key] = *activity
+	return true, nil
+}
+
+func (s *MemoryStore) GetProcessedActivity(ctx context.Context, activityId int, aspect string, eventTime int) (ProcessedActivity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity, ok := s.processedActivities[processedActivityKey{activityId, aspect, eventTime}]
+	return activity, ok
+}
+
+func (s *MemoryStore) UpdateProcessedActivity(ctx context.Context, activity ProcessedActivity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := processedActivityKey{activity.ActivityId, activity.Aspect, activity.EventTime}
+	existing := s.processedActivities[key]
+	existing.ActivityId = activity.ActivityId
+	existing.Aspect = activity.Aspect
+	existing.EventTime = activity.EventTime
+	existing.Status = activity.Status
+	existing.Outcome = activity.Outcome
+	existing.ProcessedAt = activity.ProcessedAt
+	if activity.Provider != "" {
+		existing.Provider = activity.Provider
+	}
+	s.processedActivities[key] = existing
+
+	if activity.Status == ActivityDone {
+		stats := s.athleteStats[existing.AthleteId]
+		stats.AthleteId = existing.AthleteId
+		stats.ActivitiesProcessed++
+		stats.LastProcessedAt = activity.ProcessedAt
+		s.athleteStats[existing.AthleteId] = stats
+	}
+	return nil
+}
+
+func CreateMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accessTokens:        map[int]AccessToken{},
+		refreshTokens:       map[int]RefreshToken{},
+		athleteSettings:     map[int]AthleteSettings{},
+		athleteStats:        map[int]AthleteStats{},
+		processedActivities: map[processedActivityKey]ProcessedActivity{},
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClaimProcessedActivity(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := map[string]struct {
+		existing *ProcessedActivity
+		claimed  bool
+	}{
+		"new event": {
+			claimed: true,
+		},
+		"done": {
+			existing: &ProcessedActivity{Status: ActivityDone, ClaimedAt: int(now.Add(-time.Hour).Unix())},
+			claimed:  false,
+		},
+		"failed": {
+			existing: &ProcessedActivity{Status: ActivityFailed, ClaimedAt: int(now.Add(-time.Minute).Unix())},
+			claimed:  true,
+		},
+		"in progress": {
+			existing: &ProcessedActivity{Status: ActivityProcessing, ClaimedAt: int(now.Add(-time.Minute).Unix())},
+			claimed:  false,
+		},
+		"abandoned": {
+			existing: &ProcessedActivity{Status: ActivityProcessing, ClaimedAt: int(now.Add(-time.Hour).Unix())},
+			claimed:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := CreateMemoryStore()
+			if test.existing != nil {
+				existing := *test.existing
+				existing.ActivityId, existing.Aspect, existing.EventTime = 1, "create", 2
+				store.processedActivities[processedActivityKey{1, "create", 2}] = existing
+			}
+
+			activity := ProcessedActivity{ActivityId: 1, AthleteId: 3, Aspect: "create", EventTime: 2}
+			claimed, err := store.ClaimProcessedActivity(ctx, &activity, now)
+			if err != nil {
+				t.Fatalf("ClaimProcessedActivity() got error %s", err.Error())
+			}
+			if claimed != test.claimed {
+				t.Fatalf("ClaimProcessedActivity() got %t, expected %t", claimed, test.claimed)
+			}
+			if claimed && activity.TimeToLive != int(now.Add(processedActivityRetention).Unix()) {
+				t.Fatalf("ClaimProcessedActivity() set TimeToLive %d, expected %d", activity.TimeToLive, now.Add(processedActivityRetention).Unix())
+			}
+			if !claimed && activity.Status != test.existing.Status {
+				t.Fatalf("ClaimProcessedActivity() loaded status %s, expected %s", activity.Status, test.existing.Status)
+			}
+		})
+	}
+}
+
+func TestReplaceTokens(t *testing.T) {
+	tests := map[string]struct {
+		previous string
+		replaced bool
+	}{
+		"current refresh token": {
+			previous: "refresh",
+			replaced: true,
+		},
+		"rotated refresh token": {
+			previous: "stale",
+			replaced: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := CreateMemoryStore()
+			store.UpdateAccessToken(ctx, AccessToken{AthleteId: 1, Code: "access", ExpiresAt: 1, Scope: "read"})
+			store.UpdateRefreshToken(ctx, RefreshToken{AthleteId: 1, Code: "refresh"})
+
+			replaced, err := store.ReplaceTokens(ctx, RefreshToken{AthleteId: 1, Code: test.previous},
+				AccessToken{AthleteId: 1, Code: "new-access", ExpiresAt: 2},
+				RefreshToken{AthleteId: 1, Code: "new-refresh"},
+			)
+			if err != nil {
+				t.Fatalf("ReplaceTokens() got error %s", err.Error())
+			}
+			if replaced != test.replaced {
+				t.Fatalf("ReplaceTokens() got %t, expected %t", replaced, test.replaced)
+			}
+
+			expected := AccessToken{AthleteId: 1, Code: "access", ExpiresAt: 1, Scope: "read"}
+			expectedRefresh := "refresh"
+			if test.replaced {
+				expected.Code, expected.ExpiresAt, expectedRefresh = "new-access", 2, "new-refresh"
+			}
+			if token := store.accessTokens[1]; token != expected {
+				t.Fatalf("ReplaceTokens() stored %+v, expected %+v", token, expected)
+			}
+			if token := store.refreshTokens[1]; token.Code != expectedRefresh {
+				t.Fatalf("ReplaceTokens() stored %s, expected %s", token.Code, expectedRefresh)
+			}
+		})
+	}
+}
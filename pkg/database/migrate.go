@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// LegacyTables names the per-type tables used before the single table. An
+// empty name skips that table.
+type LegacyTables struct {
+	AccessTokens    string
+	RefreshTokens   string
+	AthleteSettings string
+}
+
+// MigrateLegacyTables copies every item from the legacy tables into the single
+// table and returns the number of items written. Attributes that already exist
+// in the single table are newer and are left alone, so the migration can be
+// run again safely while the worker is running.
+func (c DynamoDBClient) MigrateLegacyTables(ctx context.Context, tables LegacyTables) (int, error) {
+	sources := []struct {
+		table   string
+		sortKey string
+		guard   string
+	}{
+		{tables.AccessTokens, tokenSortKey, "AccessToken"},
+		{tables.RefreshTokens, tokenSortKey, "RefreshToken"},
+		{tables.AthleteSettings, settingsSortKey, ""},
+	}
+
+	count := 0
+	for _, source := range sources {
+		if source.table == "" {
+			continue
+		}
+
+		copied, err := c.copyLegacyTable(ctx, source.table, source.sortKey, source.guard)
+		count += copied
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// copyLegacyTable copies the items of a table keyed by AthleteId onto items
+// with the given sort key. Each attribute is only set if it is missing, and
+// when guard is not empty the whole item is skipped if guard is already set.
+// Tokens use a guard because a newer token must not be mixed with an older
+// expiry or scope, while settings are merged attribute by attribute so that
+// the worker caching a measurement preference does not hide the athlete's
+// overrides.
+func (c DynamoDBClient) copyLegacyTable(ctx context.Context, table string, sortKey string, guard string) (int, error) {
+	count := 0
+	paginator := dynamodb.NewScanPaginator(c.svc, &dynamodb.ScanInput{TableName: aws.String(table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return count, err
+		}
+
+		for _, item := range page.Items {
+			athleteId, ok := item["AthleteId"]
+			if !ok || len(item) == 1 {
+				continue
+			}
+
+			// Numbers are kept as attributevalue.Number so they are written
+			// back exactly as they were read.
+			var values map[string]any
+			if err = attributevalue.UnmarshalMapWithOptions(item, &values, func(o *attributevalue.DecoderOptions) {
+				o.UseNumber = true
+			}); err != nil {
+				return count, err
+			}
+
+			var update expression.UpdateBuilder
+			for name, value := range values {
+				if name != "AthleteId" {
+					update = update.Set(expression.Name(name), expression.IfNotExists(expression.Name(name), expression.Value(value)))
+				}
+			}
+
+			key := map[string]types.AttributeValue{
+				"AthleteId": athleteId,
+				"SortKey":   &types.AttributeValueMemberS{Value: sortKey},
+			}
+			var condition *expression.ConditionBuilder
+			if guard != "" {
+				notExists := expression.AttributeNotExists(expression.Name(guard))
+				condition = &notExists
+			}
+
+			err = c.updateItemWithCondition(ctx, key, update, condition)
+			var ccf *types.ConditionalCheckFailedException
+			if errors.As(err, &ccf) {
+				continue
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+type attributeValue = map[string]any
+type fakeItem = map[string]attributeValue
+
+var (
+	setAction          = regexp.MustCompile(`(#\w+) = (?:if_not_exists ?\(#\w+, (:\w+)\)|(:\w+))`)
+	attributeNotExists = regexp.MustCompile(`attribute_not_exists ?\((#\w+)\)`)
+)
+
+// fakeDynamoDB answers the Scan and UpdateItem calls made by the migration,
+// applying the SET, if_not_exists and attribute_not_exists expressions it
+// builds to items held in memory.
+type fakeDynamoDB struct {
+	legacy map[string][]fakeItem
+	items  map[string]fakeItem
+}
+
+func itemKey(key fakeItem) string {
+	return key["AthleteId"]["N"].(string) + "/" + key["SortKey"]["S"].(string)
+}
+
+func (f *fakeDynamoDB) RoundTrip(req *http.Request) (*http.Response, error) {
+	var input struct {
+		TableName                 string
+		Key                       fakeItem
+		UpdateExpression          string
+		ConditionExpression       string
+		ExpressionAttributeNames  map[string]string
+		ExpressionAttributeValues map[string]attributeValue
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		return nil, err
+	}
+
+	var body any = map[string]any{}
+	status := http.StatusOK
+	switch req.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.Scan":
+		body = map[string]any{"Items": f.legacy[input.TableName], "Count": len(f.legacy[input.TableName])}
+
+	case "DynamoDB_20120810.UpdateItem":
+		key := itemKey(input.Key)
+		item, ok := f.items[key]
+		if !ok {
+			item = fakeItem{"AthleteId": input.Key["AthleteId"], "SortKey": input.Key["SortKey"]}
+		}
+
+		if match := attributeNotExists.FindStringSubmatch(input.ConditionExpression); match != nil {
+			if _, exists := item[input.ExpressionAttributeNames[match[1]]]; exists {
+				status = http.StatusBadRequest
+				body = map[string]any{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException", "message": "The conditional request failed"}
+				break
+			}
+		}
+
+		for _, match := range setAction.FindAllStringSubmatch(input.UpdateExpression, -1) {
+			name := input.ExpressionAttributeNames[match[1]]
+			if match[3] != "" {
+				item[name] = input.ExpressionAttributeValues[match[3]]
+			} else if _, exists := item[name]; !exists {
+				item[name] = input.ExpressionAttributeValues[match[2]]
+			}
+		}
+		f.items[key] = item
+
+	default:
+		return nil, errors.New("unexpected request " + req.Header.Get("X-Amz-Target"))
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}}
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(string(b)))}, nil
+}
+
+func createFakeClient(fake *fakeDynamoDB) DynamoDBClient {
+	svc := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://dynamodb.test"),
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       &http.Client{Transport: fake},
+		RetryMaxAttempts: 1,
+	})
+	return DynamoDBClient{svc: svc, table: "StravaWx"}
+}
+
+func stringValue(value string) attributeValue {
+	return attributeValue{"S": value}
+}
+
+func numberValue(value string) attributeValue {
+	return attributeValue{"N": value}
+}
+
+func TestMigrateLegacyTables(t *testing.T) {
+	fake := &fakeDynamoDB{
+		legacy: map[string][]fakeItem{
+			"AccessTokens": {
+				{"AthleteId": numberValue("1"), "AccessToken": stringValue("old-access"), "ExpiresAt": numberValue("100"), "Scope": stringValue("read")},
+				{"AthleteId": numberValue("2"), "AccessToken": stringValue("access-2"), "ExpiresAt": numberValue("200")},
+			},
+			"RefreshTokens": {
+				{"AthleteId": numberValue("1"), "RefreshToken": stringValue("old-refresh")},
+				{"AthleteId": numberValue("2"), "RefreshToken": stringValue("refresh-2")},
+			},
+			"AthleteSettings": {
+				{"AthleteId": numberValue("1"), "Units": stringValue("metric"), "Template": stringValue("{{.temp}}")},
+				{"AthleteId": numberValue("2"), "Units": stringValue("metric")},
+				{"AthleteId": numberValue("3")},
+			},
+		},
+		items: map[string]fakeItem{
+			// Athlete 1 was refreshed and had their preference cached by the
+			// new worker before the migration ran.
+			"1/TOKEN":    {"AthleteId": numberValue("1"), "SortKey": stringValue("TOKEN"), "AccessToken": stringValue("new-access"), "ExpiresAt": numberValue("300"), "RefreshToken": stringValue("new-refresh")},
+			"1/SETTINGS": {"AthleteId": numberValue("1"), "SortKey": stringValue("SETTINGS"), "MeasurementPreference": stringValue("feet")},
+			// Athlete 2 changed their units on the settings page.
+			"2/SETTINGS": {"AthleteId": numberValue("2"), "SortKey": stringValue("SETTINGS"), "Units": stringValue("uk")},
+		},
+	}
+	client := createFakeClient(fake)
+	tables := LegacyTables{AccessTokens: "AccessTokens", RefreshTokens: "RefreshTokens", AthleteSettings: "AthleteSettings"}
+
+	count, err := client.MigrateLegacyTables(context.Background(), tables)
+	if err != nil {
+		t.Fatalf("MigrateLegacyTables() got error %s", err.Error())
+	}
+	if count != 4 {
+		t.Fatalf("MigrateLegacyTables() got %d, expected 4", count)
+	}
+
+	expected := map[string]fakeItem{
+		"1/TOKEN":    {"AthleteId": numberValue("1"), "SortKey": stringValue("TOKEN"), "AccessToken": stringValue("new-access"), "ExpiresAt": numberValue("300"), "RefreshToken": stringValue("new-refresh")},
+		"1/SETTINGS": {"AthleteId": numberValue("1"), "SortKey": stringValue("SETTINGS"), "MeasurementPreference": stringValue("feet"), "Units": stringValue("metric"), "Template": stringValue("{{.temp}}")},
+		"2/TOKEN":    {"AthleteId": numberValue("2"), "SortKey": stringValue("TOKEN"), "AccessToken": stringValue("access-2"), "ExpiresAt": numberValue("200"), "RefreshToken": stringValue("refresh-2")},
+		"2/SETTINGS": {"AthleteId": numberValue("2"), "SortKey": stringValue("SETTINGS"), "Units": stringValue("uk")},
+	}
+	got, _ := json.Marshal(fake.items)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Fatalf("MigrateLegacyTables() left items %s, expected %s", got, want)
+	}
+
+	// Running the migration again changes nothing.
+	if _, err = client.MigrateLegacyTables(context.Background(), tables); err != nil {
+		t.Fatalf("MigrateLegacyTables() a second time got error %s", err.Error())
+	}
+	if again, _ := json.Marshal(fake.items); string(again) != string(want) {
+		t.Fatalf("MigrateLegacyTables() a second time left items %s, expected %s", again, want)
+	}
+}
+
+func TestMigrateLegacyTablesSkipsEmptyNames(t *testing.T) {
+	fake := &fakeDynamoDB{
+		legacy: map[string][]fakeItem{
+			"AthleteSettings": {{"AthleteId": numberValue("1"), "Units": stringValue("metric")}},
+		},
+		items: map[string]fakeItem{},
+	}
+	client := createFakeClient(fake)
+
+	count, err := client.MigrateLegacyTables(context.Background(), LegacyTables{AthleteSettings: "AthleteSettings"})
+	if err != nil {
+		t.Fatalf("MigrateLegacyTables() got error %s", err.Error())
+	}
+	if count != 1 || len(fake.items) != 1 {
+		t.Fatalf("MigrateLegacyTables() got %d and items %v, expected only the settings", count, fake.items)
+	}
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A claim older than the longest Lambda run belongs to an invocation that
+// died, so another invocation may take it over.
+const processingLease = 15 * time.Minute
+
+// Entries are kept for longer than SQS retains a message, so redelivered
+// events are still recognised, and are then removed by DynamoDB's TTL.
+const processedActivityRetention = 30 * 24 * time.Hour
+
+const (
+	ActivityProcessing = "processing"
+	ActivityDone       = "done"
+	ActivityFailed     = "failed"
+)
+
+type ProcessedActivity struct {
+	ActivityId  int    `dynamodbav:"ActivityId"`
+	AthleteId   int    `dynamodbav:"AthleteId"`
+	Aspect      string `dynamodbav:"Aspect"`
+	EventTime   int    `dynamodbav:"EventTime"`
+	Status      string `dynamodbav:"Status"`
+	Outcome     string `dynamodbav:"Outcome,omitempty"`
+	Provider    string `dynamodbav:"Provider,omitempty"`
+	ClaimedAt   int    `dynamodbav:"ClaimedAt"`
+	ProcessedAt int    `dynamodbav:"ProcessedAt,omitempty"`
+	TimeToLive  int    `dynamodbav:"TimeToLive,omitempty"`
+}
+
+func (p ProcessedActivity) GetKey() map[string]types.AttributeValue {
+	return athleteKey(p.AthleteId, activitySortKeyPrefix+strconv.Itoa(p.ActivityId)+"#"+p.Aspect+"#"+strconv.Itoa(p.EventTime))
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const shortRateLimitWindow = 15 * time.Minute
+
+type RateLimitUsage struct {
+	Id         string `dynamodbav:"Id"`
+	ShortLimit int    `dynamodbav:"ShortLimit"`
+	ShortUsage int    `dynamodbav:"ShortUsage"`
+	DailyLimit int    `dynamodbav:"DailyLimit"`
+	DailyUsage int    `dynamodbav:"DailyUsage"`
+	UpdatedAt  int    `dynamodbav:"UpdatedAt"`
+}
+
+// GetDelay returns how long to wait until the rate limit window that is at or
+// above threshold resets. Strava resets the short window every quarter hour
+// and the daily window at midnight UTC.
+func (r RateLimitUsage) GetDelay(now time.Time, threshold float64) time.Duration {
+	now = now.UTC()
+	updatedAt := time.Unix(int64(r.UpdatedAt), 0).UTC()
+
+	var delay time.Duration
+	shortStart := now.Truncate(shortRateLimitWindow)
+	if !updatedAt.Before(shortStart) && r.ShortLimit > 0 && float64(r.ShortUsage) >= threshold*float64(r.ShortLimit) {
+		delay = shortStart.Add(shortRateLimitWindow).Sub(now)
+	}
+
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !updatedAt.Before(dayStart) && r.DailyLimit > 0 && float64(r.DailyUsage) >= threshold*float64(r.DailyLimit) {
+		delay = dayStart.AddDate(0, 0, 1).Sub(now)
+	}
+
+	return delay
+}
+
+func (r RateLimitUsage) GetKey() map[string]types.AttributeValue {
+	return athleteKey(0, rateLimitSortKeyPrefix+r.Id)
+}
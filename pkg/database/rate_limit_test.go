@@ -0,0 +1,48 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetDelay(t *testing.T) {
+	now := time.Date(2023, 11, 14, 14, 40, 0, 0, time.UTC)
+	updatedAt := int(now.Add(-time.Minute).Unix())
+
+	tests := map[string]struct {
+		input  RateLimitUsage
+		result time.Duration
+	}{
+		"below threshold": {
+			input:  RateLimitUsage{ShortLimit: 200, ShortUsage: 100, DailyLimit: 2000, DailyUsage: 1000, UpdatedAt: updatedAt},
+			result: 0,
+		},
+		"short window": {
+			input:  RateLimitUsage{ShortLimit: 200, ShortUsage: 190, DailyLimit: 2000, DailyUsage: 1000, UpdatedAt: updatedAt},
+			result: 5 * time.Minute,
+		},
+		"daily window": {
+			input:  RateLimitUsage{ShortLimit: 200, ShortUsage: 190, DailyLimit: 2000, DailyUsage: 1900, UpdatedAt: updatedAt},
+			result: 9*time.Hour + 20*time.Minute,
+		},
+		"short window already reset": {
+			input:  RateLimitUsage{ShortLimit: 200, ShortUsage: 200, DailyLimit: 2000, DailyUsage: 1000, UpdatedAt: int(now.Add(-20 * time.Minute).Unix())},
+			result: 0,
+		},
+		"daily window already reset": {
+			input:  RateLimitUsage{ShortLimit: 200, ShortUsage: 0, DailyLimit: 2000, DailyUsage: 2000, UpdatedAt: int(now.Add(-15 * time.Hour).Unix())},
+			result: 0,
+		},
+		"never recorded": {
+			input:  RateLimitUsage{},
+			result: 0,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := test.input.GetDelay(now, 0.9), test.result; got != expected {
+				t.Fatalf("GetDelay() got %s, expected %s", got, expected)
+			}
+		})
+	}
+}
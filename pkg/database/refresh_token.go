@@ -1,18 +1,32 @@
 package database
 
 import (
-	"strconv"
-
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type RefreshToken struct {
 	AthleteId int    `dynamodbav:"AthleteId"`
 	Code      string `dynamodbav:"RefreshToken"`
+
+	// stored is the value as read from the database, which differs from Code
+	// when tokens are encrypted. ReplaceTokens compares against it.
+	stored string
 }
 
 func (r RefreshToken) GetKey() map[string]types.AttributeValue {
-	return map[string]types.AttributeValue{
-		"AthleteId": &types.AttributeValueMemberN{Value: strconv.Itoa(r.AthleteId)},
+	return athleteKey(r.AthleteId, tokenSortKey)
+}
+
+// StoredCode returns the refresh token as it was read from the database.
+func (r RefreshToken) StoredCode() string {
+	if r.stored != "" {
+		return r.stored
 	}
+	return r.Code
+}
+
+// SetStoredCode records the refresh token as it was read from the database,
+// for stores outside this package.
+func (r *RefreshToken) SetStoredCode(stored string) {
+	r.stored = stored
 }
@@ -0,0 +1,278 @@
+// Package sqlstore keeps tokens in a SQL database. It only covers tokens, so
+// strava-wx cannot run outside AWS on it yet. It is separate from the
+// database package so that only the commands that use it link the SQLite
+// driver.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"strava-wx/pkg/database"
+
+	_ "modernc.org/sqlite"
+)
+
+// Migrations are applied in order and recorded in schema_migrations, so new
+// entries must only ever be appended. The SQL is kept to what both SQLite and
+// Postgres accept.
+var migrations = []string{
+	`CREATE TABLE access_tokens (
+		athlete_id         INTEGER PRIMARY KEY,
+		access_token       TEXT NOT NULL,
+		expires_at         INTEGER NOT NULL,
+		scope              TEXT NOT NULL DEFAULT '',
+		insufficient_scope BOOLEAN NOT NULL DEFAULT FALSE
+	)`,
+	`CREATE TABLE refresh_tokens (
+		athlete_id    INTEGER PRIMARY KEY,
+		refresh_token TEXT NOT NULL
+	)`,
+}
+
+// TokenStore implements database.TokenStore. Settings, stats and the
+// processing ledger are only kept in DynamoDB.
+type TokenStore struct {
+	db       *sql.DB
+	envelope *database.Envelope
+}
+
+var _ database.TokenStore = TokenStore{}
+
+func (s TokenStore) GetAccessToken(ctx context.Context, athleteId int) (database.AccessToken, error) {
+	token := database.AccessToken{AthleteId: athleteId}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT access_token, expires_at, scope, insufficient_scope FROM access_tokens WHERE athlete_id = $1`,
+		athleteId,
+	).Scan(&token.Code, &token.ExpiresAt, &token.Scope, &token.InsufficientScope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, database.CreateDatabaseError(athleteId)
+	}
+	if err != nil {
+		return token, err
+	}
+
+	token.Code, err = s.envelope.Decrypt(ctx, athleteId, database.AccessTokenAttribute, token.Code)
+	return token, err
+}
+
+func (s TokenStore) UpdateAccessToken(ctx context.Context, token database.AccessToken) error {
+	code, err := s.envelope.Encrypt(ctx, token.AthleteId, database.AccessTokenAttribute, token.Code)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO access_tokens (athlete_id, access_token, expires_at, scope) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (athlete_id) DO UPDATE SET
+			access_token = excluded.access_token,
+			expires_at = excluded.expires_at,
+			scope = CASE WHEN excluded.scope = '' THEN access_tokens.scope ELSE excluded.scope END,
+			insufficient_scope = CASE WHEN excluded.scope = '' THEN access_tokens.insufficient_scope ELSE FALSE END`,
+		token.AthleteId, code, token.ExpiresAt, token.Scope,
+	)
+	return err
+}
+
+func (s TokenStore) FlagInsufficientScope(ctx context.Context, token database.AccessToken) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE access_tokens SET insufficient_scope = TRUE WHERE athlete_id = $1`, token.AthleteId)
+	return err
+}
+
+func (s TokenStore) GetRefreshToken(ctx context.Context, athleteId int) (database.RefreshToken, error) {
+	token := database.RefreshToken{AthleteId: athleteId}
+	var stored string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT refresh_token FROM refresh_tokens WHERE athlete_id = $1`,
+		athleteId,
+	).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, database.CreateDatabaseError(athleteId)
+	}
+	if err != nil {
+		return token, err
+	}
+
+	token.SetStoredCode(stored)
+	token.Code, err = s.envelope.Decrypt(ctx, athleteId, database.RefreshTokenAttribute, stored)
+	return token, err
+}
+
+func (s TokenStore) UpdateRefreshToken(ctx context.Context, token database.RefreshToken) error {
+	code, err := s.envelope.Encrypt(ctx, token.AthleteId, database.RefreshTokenAttribute, token.Code)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (athlete_id, refresh_token) VALUES ($1, $2)
+		ON CONFLICT (athlete_id) DO UPDATE SET refresh_token = excluded.refresh_token`,
+		token.AthleteId, code,
+	)
+	return err
+}
+
+func (s TokenStore) ReplaceTokens(ctx context.Context, previous database.RefreshToken, accessToken database.AccessToken, refreshToken database.RefreshToken) (bool, error) {
+	accessCode, err := s.envelope.Encrypt(ctx, accessToken.AthleteId, database.AccessTokenAttribute, accessToken.Code)
+	if err != nil {
+		return false, err
+	}
+	refreshCode, err := s.envelope.Encrypt(ctx, refreshToken.AthleteId, database.RefreshTokenAttribute, refreshToken.Code)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE refresh_tokens SET refresh_token = $1 WHERE athlete_id = $2 AND refresh_token = $3`,
+		refreshCode, refreshToken.AthleteId, previous.StoredCode(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		`UPDATE access_tokens SET access_token = $1, expires_at = $2 WHERE athlete_id = $3`,
+		accessCode, accessToken.ExpiresAt, accessToken.AthleteId,
+	); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReencryptTokens encrypts every stored token that is in plain text or was
+// encrypted with an old key using the current key, and returns the number of
+// tokens rewritten.
+func (s TokenStore) ReencryptTokens(ctx context.Context) (int, error) {
+	if s.envelope == nil {
+		return 0, database.ErrEncryptionNotConfigured
+	}
+
+	accessTokens, err := s.reencryptTable(ctx, "access_tokens", "access_token", database.AccessTokenAttribute)
+	if err != nil {
+		return accessTokens, err
+	}
+	refreshTokens, err := s.reencryptTable(ctx, "refresh_tokens", "refresh_token", database.RefreshTokenAttribute)
+	return accessTokens + refreshTokens, err
+}
+
+func (s TokenStore) reencryptTable(ctx context.Context, table string, column string, attribute string) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT athlete_id, `+column+` FROM `+table)
+	if err != nil {
+		return 0, err
+	}
+
+	stored := map[int]string{}
+	for rows.Next() {
+		var athleteId int
+		var value string
+		if err = rows.Scan(&athleteId, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if s.envelope.NeedsRotation(value) {
+			stored[athleteId] = value
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for athleteId, value := range stored {
+		plaintext, err := s.envelope.Decrypt(ctx, athleteId, attribute, value)
+		if err != nil {
+			return count, err
+		}
+		code, err := s.envelope.Encrypt(ctx, athleteId, attribute, plaintext)
+		if err != nil {
+			return count, err
+		}
+
+		// A token refreshed since it was read is already encrypted with the
+		// current key and must not be overwritten.
+		result, err := s.db.ExecContext(ctx,
+			`UPDATE `+table+` SET `+column+` = $1 WHERE athlete_id = $2 AND `+column+` = $3`,
+			code, athleteId, value,
+		)
+		if err != nil {
+			return count, err
+		}
+		if rows, err := result.RowsAffected(); err == nil && rows > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s TokenStore) Close() error {
+	return s.db.Close()
+}
+
+func (s TokenStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func CreateSQLiteStore(ctx context.Context, path string) (TokenStore, error) {
+	// SQLite allows a single writer, and a busy timeout lets other processes
+	// wait for it instead of failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return TokenStore{}, err
+	}
+	db.SetMaxOpenConns(1)
+
+	envelope, err := database.CreateEnvelopeFromEnv(ctx)
+	if err != nil {
+		db.Close()
+		return TokenStore{}, err
+	}
+
+	store := TokenStore{db, envelope}
+	if err = store.migrate(ctx); err != nil {
+		db.Close()
+		return TokenStore{}, err
+	}
+	return store, nil
+}
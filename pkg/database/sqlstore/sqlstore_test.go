@@ -0,0 +1,210 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"strava-wx/pkg/database"
+)
+
+func writeKeyFile(t *testing.T, current string, ids ...string) string {
+	keys := []string{}
+	for i, id := range ids {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32)))
+		keys = append(keys, `"`+id+`":"`+key+`"`)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	contents := `{"current":"` + current + `","keys":{` + strings.Join(keys, ",") + `}}`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func createTestSQLiteStore(t *testing.T) TokenStore {
+	return createTestSQLiteStoreAt(t, filepath.Join(t.TempDir(), "strava-wx.db"))
+}
+
+func createTestSQLiteStoreAt(t *testing.T, path string) TokenStore {
+	store, err := CreateSQLiteStore(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "strava-wx.db")
+	ctx := context.Background()
+
+	for range 2 {
+		store, err := CreateSQLiteStore(ctx, path)
+		if err != nil {
+			t.Fatalf("CreateSQLiteStore() got error %s", err.Error())
+		}
+
+		var version int
+		if err := store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) {
+			t.Fatalf("schema version %d, expected %d", version, len(migrations))
+		}
+		store.Close()
+	}
+}
+
+func TestSQLStoreAccessToken(t *testing.T) {
+	store := createTestSQLiteStore(t)
+	ctx := context.Background()
+
+	_, err := store.GetAccessToken(ctx, 1)
+	var de *database.DatabaseError
+	if !errors.As(err, &de) {
+		t.Fatalf("GetAccessToken() got error %v, expected DatabaseError", err)
+	}
+
+	steps := []struct {
+		update func() error
+		result database.AccessToken
+	}{
+		{
+			update: func() error {
+				return store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: 1, Code: "a", ExpiresAt: 10, Scope: "read,activity:write"})
+			},
+			result: database.AccessToken{AthleteId: 1, Code: "a", ExpiresAt: 10, Scope: "read,activity:write"},
+		},
+		{
+			update: func() error {
+				return store.FlagInsufficientScope(ctx, database.AccessToken{AthleteId: 1})
+			},
+			result: database.AccessToken{AthleteId: 1, Code: "a", ExpiresAt: 10, Scope: "read,activity:write", InsufficientScope: true},
+		},
+		{
+			update: func() error {
+				return store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: 1, Code: "b", ExpiresAt: 20})
+			},
+			result: database.AccessToken{AthleteId: 1, Code: "b", ExpiresAt: 20, Scope: "read,activity:write", InsufficientScope: true},
+		},
+		{
+			update: func() error {
+				return store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: 1, Code: "c", ExpiresAt: 30, Scope: "read,activity:read_all,activity:write"})
+			},
+			result: database.AccessToken{AthleteId: 1, Code: "c", ExpiresAt: 30, Scope: "read,activity:read_all,activity:write"},
+		},
+	}
+	for i, step := range steps {
+		if err := step.update(); err != nil {
+			t.Fatalf("step %d got error %s", i, err.Error())
+		}
+		token, err := store.GetAccessToken(ctx, 1)
+		if err != nil {
+			t.Fatalf("step %d GetAccessToken() got error %s", i, err.Error())
+		}
+		if token != step.result {
+			t.Fatalf("step %d GetAccessToken() got %+v, expected %+v", i, token, step.result)
+		}
+	}
+}
+
+func TestSQLStoreRefreshToken(t *testing.T) {
+	store := createTestSQLiteStore(t)
+	ctx := context.Background()
+
+	_, err := store.GetRefreshToken(ctx, 1)
+	var de *database.DatabaseError
+	if !errors.As(err, &de) {
+		t.Fatalf("GetRefreshToken() got error %v, expected DatabaseError", err)
+	}
+
+	for _, code := range []string{"a", "b"} {
+		if err := store.UpdateRefreshToken(ctx, database.RefreshToken{AthleteId: 1, Code: code}); err != nil {
+			t.Fatalf("UpdateRefreshToken() got error %s", err.Error())
+		}
+		token, err := store.GetRefreshToken(ctx, 1)
+		if err != nil {
+			t.Fatalf("GetRefreshToken() got error %s", err.Error())
+		}
+		if token.Code != code {
+			t.Fatalf("GetRefreshToken() got %s, expected %s", token.Code, code)
+		}
+	}
+
+	replaced, err := store.ReplaceTokens(ctx, database.RefreshToken{AthleteId: 1, Code: "a"}, database.AccessToken{AthleteId: 1}, database.RefreshToken{AthleteId: 1, Code: "c"})
+	if err != nil || replaced {
+		t.Fatalf("ReplaceTokens() with a stale refresh token got %t, %v, expected false", replaced, err)
+	}
+	if err := store.UpdateAccessToken(ctx, database.AccessToken{AthleteId: 1, Code: "a", ExpiresAt: 10, Scope: "read"}); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err = store.ReplaceTokens(ctx, database.RefreshToken{AthleteId: 1, Code: "b"}, database.AccessToken{AthleteId: 1, Code: "c", ExpiresAt: 20}, database.RefreshToken{AthleteId: 1, Code: "c"})
+	if err != nil || !replaced {
+		t.Fatalf("ReplaceTokens() got %t, %v, expected true", replaced, err)
+	}
+	accessToken, _ := store.GetAccessToken(ctx, 1)
+	refreshToken, _ := store.GetRefreshToken(ctx, 1)
+	if accessToken != (database.AccessToken{AthleteId: 1, Code: "c", ExpiresAt: 20, Scope: "read"}) || refreshToken.Code != "c" {
+		t.Fatalf("ReplaceTokens() stored %+v and %s", accessToken, refreshToken.Code)
+	}
+}
+
+func TestSQLStoreEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "strava-wx.db")
+	ctx := context.Background()
+
+	plain, err := CreateSQLiteStore(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.UpdateAccessToken(ctx, database.AccessToken{AthleteId: 1, Code: "access", ExpiresAt: 10})
+	plain.UpdateRefreshToken(ctx, database.RefreshToken{AthleteId: 1, Code: "refresh"})
+	plain.Close()
+
+	t.Setenv("TOKEN_KEY_FILE", writeKeyFile(t, "k1", "k1"))
+	store := createTestSQLiteStoreAt(t, path)
+
+	count, err := store.ReencryptTokens(ctx)
+	if err != nil {
+		t.Fatalf("ReencryptTokens() got error %s", err.Error())
+	}
+	if count != 2 {
+		t.Fatalf("ReencryptTokens() got %d, expected 2", count)
+	}
+	if count, _ = store.ReencryptTokens(ctx); count != 0 {
+		t.Fatalf("ReencryptTokens() a second time got %d, expected 0", count)
+	}
+
+	var stored string
+	store.db.QueryRow(`SELECT refresh_token FROM refresh_tokens WHERE athlete_id = 1`).Scan(&stored)
+	if !strings.HasPrefix(stored, "enc2.") {
+		t.Fatalf("ReencryptTokens() stored %s, expected an encrypted value", stored)
+	}
+
+	// A ciphertext copied to another athlete must not decrypt.
+	store.db.Exec(`INSERT INTO refresh_tokens (athlete_id, refresh_token) VALUES (2, $1)`, stored)
+	var ee *database.EncryptionError
+	if _, err := store.GetRefreshToken(ctx, 2); !errors.As(err, &ee) {
+		t.Fatalf("GetRefreshToken() of a copied token got error %v, expected EncryptionError", err)
+	}
+
+	refreshToken, err := store.GetRefreshToken(ctx, 1)
+	if err != nil || refreshToken.Code != "refresh" {
+		t.Fatalf("GetRefreshToken() got %s, %v, expected refresh", refreshToken.Code, err)
+	}
+	replaced, err := store.ReplaceTokens(ctx, refreshToken, database.AccessToken{AthleteId: 1, Code: "new-access", ExpiresAt: 20}, database.RefreshToken{AthleteId: 1, Code: "new-refresh"})
+	if err != nil || !replaced {
+		t.Fatalf("ReplaceTokens() got %t, %v, expected true", replaced, err)
+	}
+
+	accessToken, err := store.GetAccessToken(ctx, 1)
+	if err != nil || accessToken.Code != "new-access" {
+		t.Fatalf("GetAccessToken() got %s, %v, expected new-access", accessToken.Code, err)
+	}
+}
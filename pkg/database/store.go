@@ -0,0 +1,31 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+type TokenStore interface {
+	GetAccessToken(ctx context.Context, athleteId int) (AccessToken, error)
+	UpdateAccessToken(ctx context.Context, token AccessToken) error
+	FlagInsufficientScope(ctx context.Context, token AccessToken) error
+	GetRefreshToken(ctx context.Context, athleteId int) (RefreshToken, error)
+	UpdateRefreshToken(ctx context.Context, token RefreshToken) error
+	ReplaceTokens(ctx context.Context, previous RefreshToken, accessToken AccessToken, refreshToken RefreshToken) (bool, error)
+}
+
+type Store interface {
+	TokenStore
+	GetAthleteSettings(ctx context.Context, athleteId int) (AthleteSettings, error)
+	PutAthleteSettings(ctx context.Context, settings AthleteSettings) error
+	UpdateMeasurementPreference(ctx context.Context, settings AthleteSettings) error
+	DeleteAthlete(ctx context.Context, athleteId int) error
+	GetAthleteStats(ctx context.Context, athleteId int) (AthleteStats, error)
+	GetRateLimitUsage(ctx context.Context) (RateLimitUsage, error)
+	UpdateRateLimitUsage(ctx context.Context, usage RateLimitUsage) error
+	ClaimProcessedActivity(ctx context.Context, activity *ProcessedActivity, now time.Time) (bool, error)
+	UpdateProcessedActivity(ctx context.Context, activity ProcessedActivity) error
+}
+
+var _ Store = DynamoDBClient{}
+var _ Store = (*MemoryStore)(nil)
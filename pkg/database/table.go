@@ -0,0 +1,35 @@
+package database
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Every item lives in a single table with partition key AthleteId and sort
+// key SortKey, where the sort key says what kind of item it is. Items that do
+// not belong to an athlete, such as rate limit usage, use AthleteId 0.
+const (
+	tokenSortKey           = "TOKEN"
+	settingsSortKey        = "SETTINGS"
+	statsSortKey           = "STATS"
+	activitySortKeyPrefix  = "ACTIVITY#"
+	rateLimitSortKeyPrefix = "RATELIMIT#"
+)
+
+const defaultTableName = "StravaWx"
+
+func athleteKey(athleteId int, sortKey string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"AthleteId": &types.AttributeValueMemberN{Value: strconv.Itoa(athleteId)},
+		"SortKey":   &types.AttributeValueMemberS{Value: sortKey},
+	}
+}
+
+func getTableName() string {
+	if name := os.Getenv("TABLE_NAME"); name != "" {
+		return name
+	}
+	return defaultTableName
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestGetKey(t *testing.T) {
+	tests := map[string]struct {
+		key       map[string]types.AttributeValue
+		athleteId string
+		sortKey   string
+	}{
+		"access token": {
+			key:       AccessToken{AthleteId: 1}.GetKey(),
+			athleteId: "1",
+			sortKey:   "TOKEN",
+		},
+		"refresh token": {
+			key:       RefreshToken{AthleteId: 1}.GetKey(),
+			athleteId: "1",
+			sortKey:   "TOKEN",
+		},
+		"settings": {
+			key:       AthleteSettings{AthleteId: 1}.GetKey(),
+			athleteId: "1",
+			sortKey:   "SETTINGS",
+		},
+		"stats": {
+			key:       AthleteStats{AthleteId: 1}.GetKey(),
+			athleteId: "1",
+			sortKey:   "STATS",
+		},
+		"activity": {
+			key:       ProcessedActivity{AthleteId: 1, ActivityId: 2, Aspect: "create", EventTime: 3}.GetKey(),
+			athleteId: "1",
+			sortKey:   "ACTIVITY#2#create#3",
+		},
+		"rate limit": {
+			key:       RateLimitUsage{Id: "strava"}.GetKey(),
+			athleteId: "0",
+			sortKey:   "RATELIMIT#strava",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			athleteId := test.key["AthleteId"].(*types.AttributeValueMemberN).Value
+			sortKey := test.key["SortKey"].(*types.AttributeValueMemberS).Value
+			if len(test.key) != 2 || athleteId != test.athleteId || sortKey != test.sortKey {
+				t.Fatalf("GetKey() got %s and %s, expected %s and %s", athleteId, sortKey, test.athleteId, test.sortKey)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package queue
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -20,6 +22,23 @@ func (c SQSClient) Send(ctx context.Context, messageBody, queueUrl string) error
 	return err
 }
 
+func (c SQSClient) ChangeVisibility(ctx context.Context, receiptHandle, queueUrl string, timeout int32) error {
+	_, err := c.svc.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: timeout,
+	})
+	return err
+}
+
+func GetQueueUrl(queueArn string) (string, error) {
+	parts := strings.Split(queueArn, ":")
+	if len(parts) != 6 || parts[2] != "sqs" {
+		return "", fmt.Errorf("invalid queue ARN %s", queueArn)
+	}
+	return fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", parts[3], parts[4], parts[5]), nil
+}
+
 func CreateClient(ctx context.Context) (SQSClient, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -5,11 +5,49 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type ActivityResponse struct {
+	Description  string
+	Sport_type   string
 	Start_date   string
 	Start_latlng []float64
+	Trainer      bool
+	Manual       bool
+	Device_name  string
+}
+
+// virtualPlatforms are apps whose recordings are virtual even when uploaded
+// with an outdoor sport type.
+var virtualPlatforms = []string{"zwift", "trainerroad", "rouvy", "mywhoosh", "bkool", "fulgaz"}
+
+// IsVirtual reports whether the activity took place in a virtual world, either
+// because of its sport type or the app that recorded it.
+func (a ActivityResponse) IsVirtual() bool {
+	if strings.HasPrefix(a.Sport_type, "Virtual") {
+		return true
+	}
+
+	device := strings.ToLower(a.Device_name)
+	for _, platform := range virtualPlatforms {
+		if strings.Contains(device, platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatableActivity holds the fields Strava allows to be changed. Only
+// non-nil fields are sent, so unset fields keep their current values.
+type UpdatableActivity struct {
+	Commute        *bool   `json:"commute,omitempty"`
+	Trainer        *bool   `json:"trainer,omitempty"`
+	Hide_from_home *bool   `json:"hide_from_home,omitempty"`
+	Description    *string `json:"description,omitempty"`
+	Name           *string `json:"name,omitempty"`
+	Sport_type     *string `json:"sport_type,omitempty"`
+	Gear_id        *string `json:"gear_id,omitempty"`
 }
 
 func GetActivity(client *http.Client, activityId int, accessToken string) (ar ActivityResponse, err error) {
@@ -25,11 +63,20 @@ func GetActivity(client *http.Client, activityId int, accessToken string) (ar Ac
 	}
 
 	defer resp.Body.Close()
+
+	if err = checkResponse(resp, "GET /activities/{id}"); err != nil {
+		return ar, err
+	}
+
 	return ar, json.NewDecoder(resp.Body).Decode(&ar)
 }
 
-func UpdateActivity(client *http.Client, activityId int, accessToken string, description string) error {
-	payload := []byte(`{"description":"` + description + `"}`)
+func UpdateActivity(client *http.Client, activityId int, accessToken string, update UpdatableActivity) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
 	req, err := http.NewRequest("PUT", "https://www.strava.com/api/v3/activities/"+strconv.Itoa(activityId), bytes.NewBuffer(payload))
 	if err != nil {
 		return err
@@ -38,6 +85,11 @@ func UpdateActivity(client *http.Client, activityId int, accessToken string, des
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	_, err = client.Do(req)
-	return err
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	return checkResponse(resp, "PUT /activities/{id}")
 }
@@ -0,0 +1,121 @@
+package strava
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUpdateActivity(t *testing.T) {
+	name := "Morning Run"
+	trainer := false
+
+	tests := map[string]struct {
+		input  UpdatableActivity
+		fields []string
+	}{
+		"quotes": {
+			input:  UpdatableActivity{Description: ptr(`She said "hi" and left`)},
+			fields: []string{"description"},
+		},
+		"injection": {
+			input:  UpdatableActivity{Description: ptr(`x","private":true,"name":"pwned`)},
+			fields: []string{"description"},
+		},
+		"backslashes and newlines": {
+			input:  UpdatableActivity{Description: ptr("C:\\runs\\today\n\tline two\r\n")},
+			fields: []string{"description"},
+		},
+		"unicode": {
+			input:  UpdatableActivity{Description: ptr("🌧️ Regen, 10°C\u2063 <b>&</b> \u0000 \u2028")},
+			fields: []string{"description"},
+		},
+		"empty description": {
+			input:  UpdatableActivity{Description: ptr("")},
+			fields: []string{"description"},
+		},
+		"several fields": {
+			input:  UpdatableActivity{Name: &name, Trainer: &trainer, Description: ptr("Easy")},
+			fields: []string{"description", "name", "trainer"},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var body []byte
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method != "PUT" || req.URL.String() != "https://www.strava.com/api/v3/activities/42" {
+					t.Errorf("unexpected request %s %s", req.Method, req.URL)
+				}
+				if req.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("unexpected Content-Type %s", req.Header.Get("Content-Type"))
+				}
+
+				var err error
+				if body, err = io.ReadAll(req.Body); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+			})}
+
+			if err := UpdateActivity(client, 42, "token", test.input); err != nil {
+				t.Fatalf("UpdateActivity() got error %s", err.Error())
+			}
+
+			var fields map[string]any
+			if err := json.Unmarshal(body, &fields); err != nil {
+				t.Fatalf("UpdateActivity() sent invalid JSON %s: %s", body, err.Error())
+			}
+			if len(fields) != len(test.fields) {
+				t.Fatalf("UpdateActivity() sent fields %v, expected %v", fields, test.fields)
+			}
+			for _, field := range test.fields {
+				if _, ok := fields[field]; !ok {
+					t.Fatalf("UpdateActivity() sent fields %v, expected %v", fields, test.fields)
+				}
+			}
+
+			var got UpdatableActivity
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if *got.Description != *test.input.Description {
+				t.Fatalf("UpdateActivity() sent description %q, expected %q", *got.Description, *test.input.Description)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestIsVirtual(t *testing.T) {
+	tests := map[string]struct {
+		activity ActivityResponse
+		virtual  bool
+	}{
+		"outdoor ride":   {ActivityResponse{Sport_type: "Ride", Device_name: "Garmin Edge 530"}, false},
+		"virtual ride":   {ActivityResponse{Sport_type: "VirtualRide"}, true},
+		"virtual run":    {ActivityResponse{Sport_type: "VirtualRun"}, true},
+		"zwift upload":   {ActivityResponse{Sport_type: "Ride", Device_name: "Zwift"}, true},
+		"no device":      {ActivityResponse{Sport_type: "Run"}, false},
+		"case of device": {ActivityResponse{Sport_type: "Ride", Device_name: "MyWhoosh App"}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if virtual := test.activity.IsVirtual(); virtual != test.virtual {
+				t.Fatalf("IsVirtual() got %t, expected %t", virtual, test.virtual)
+			}
+		})
+	}
+}
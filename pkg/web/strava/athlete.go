@@ -0,0 +1,32 @@
+package strava
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type AthleteResponse struct {
+	Id                     int
+	Measurement_preference string
+}
+
+func GetAthlete(client *http.Client, accessToken string) (ar AthleteResponse, err error) {
+	req, err := http.NewRequest("GET", "https://www.strava.com/api/v3/athlete", nil)
+	if err != nil {
+		return ar, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return ar, err
+	}
+
+	defer resp.Body.Close()
+
+	if err = checkResponse(resp, "GET /athlete"); err != nil {
+		return ar, err
+	}
+
+	return ar, json.NewDecoder(resp.Body).Decode(&ar)
+}
@@ -0,0 +1,55 @@
+package strava
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetAthlete(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		athlete AthleteResponse
+		failed  bool
+	}{
+		"detailed athlete": {
+			status:  http.StatusOK,
+			body:    `{"id":1234,"firstname":"Jo","measurement_preference":"meters"}`,
+			athlete: AthleteResponse{Id: 1234, Measurement_preference: "meters"},
+		},
+		"summary athlete": {
+			status:  http.StatusOK,
+			body:    `{"id":1234,"firstname":"Jo"}`,
+			athlete: AthleteResponse{Id: 1234},
+		},
+		"unauthorized": {
+			status: http.StatusUnauthorized,
+			body:   `{"message":"Authorization Error","errors":[{"resource":"Athlete","field":"access_token","code":"invalid"}]}`,
+			failed: true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method != "GET" || req.URL.String() != "https://www.strava.com/api/v3/athlete" {
+					t.Errorf("unexpected request %s %s", req.Method, req.URL)
+				}
+				if req.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("unexpected Authorization %s", req.Header.Get("Authorization"))
+				}
+				return &http.Response{StatusCode: test.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(test.body))}, nil
+			})}
+
+			athlete, err := GetAthlete(client, "token")
+			if (err != nil) != test.failed {
+				t.Fatalf("GetAthlete() got error %v, expected failed %t", err, test.failed)
+			}
+			if athlete != test.athlete {
+				t.Fatalf("GetAthlete() got %+v, expected %+v", athlete, test.athlete)
+			}
+		})
+	}
+}
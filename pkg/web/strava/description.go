@@ -0,0 +1,29 @@
+package strava
+
+import (
+	"strings"
+)
+
+// The weather block is wrapped in invisible separators so it can be found and
+// replaced later without touching anything the athlete wrote.
+const descriptionMarker = "\u2063"
+
+func MergeDescription(existing, block string, prepend bool) string {
+	block = descriptionMarker + block + descriptionMarker
+
+	if start := strings.Index(existing, descriptionMarker); start != -1 {
+		rest := existing[start+len(descriptionMarker):]
+		if end := strings.Index(rest, descriptionMarker); end != -1 {
+			return existing[:start] + block + rest[end+len(descriptionMarker):]
+		}
+	}
+
+	existing = strings.TrimSpace(existing)
+	if existing == "" {
+		return block
+	}
+	if prepend {
+		return block + "\n\n" + existing
+	}
+	return existing + "\n\n" + block
+}
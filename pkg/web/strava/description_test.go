@@ -0,0 +1,56 @@
+package strava
+
+import (
+	"testing"
+)
+
+func TestMergeDescription(t *testing.T) {
+	const m = descriptionMarker
+
+	tests := map[string]struct {
+		existing string
+		block    string
+		prepend  bool
+		result   string
+	}{
+		"empty": {
+			existing: "",
+			block:    "☀️ Sunny",
+			result:   m + "☀️ Sunny" + m,
+		},
+		"append": {
+			existing: "Easy run with Sam\n",
+			block:    "☀️ Sunny",
+			result:   "Easy run with Sam\n\n" + m + "☀️ Sunny" + m,
+		},
+		"prepend": {
+			existing: "Easy run with Sam",
+			block:    "☀️ Sunny",
+			prepend:  true,
+			result:   m + "☀️ Sunny" + m + "\n\nEasy run with Sam",
+		},
+		"replace appended block": {
+			existing: "Easy run with Sam\n\n" + m + "☀️ Sunny" + m,
+			block:    "🌧️ Rain",
+			result:   "Easy run with Sam\n\n" + m + "🌧️ Rain" + m,
+		},
+		"replace block in the middle": {
+			existing: "Before\n" + m + "☀️ Sunny\nWind 5mph" + m + "\nAfter",
+			block:    "🌧️ Rain",
+			prepend:  true,
+			result:   "Before\n" + m + "🌧️ Rain" + m + "\nAfter",
+		},
+		"unterminated marker": {
+			existing: "Typo " + m,
+			block:    "☀️ Sunny",
+			result:   "Typo " + m + "\n\n" + m + "☀️ Sunny" + m,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := MergeDescription(test.existing, test.block, test.prepend), test.result; got != expected {
+				t.Fatalf("MergeDescription() got %q, expected %q", got, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package strava
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type ErrorDetail struct {
+	Resource string
+	Field    string
+	Code     string
+}
+
+type StravaError struct {
+	StatusCode int
+	Endpoint   string
+	Message    string
+	Errors     []ErrorDetail
+}
+
+func (e *StravaError) Error() string {
+	return fmt.Sprintf("Strava %s returned status %d: %s %+v", e.Endpoint, e.StatusCode, e.Message, e.Errors)
+}
+
+// IsPermanent reports whether err is a Strava response that retrying cannot
+// fix, such as a deleted activity or a revoked token.
+func IsPermanent(err error) bool {
+	var se *StravaError
+	if errors.As(err, &se) {
+		return se.StatusCode != http.StatusTooManyRequests && se.StatusCode < http.StatusInternalServerError
+	}
+	return false
+}
+
+func IsNotFound(err error) bool {
+	var se *StravaError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+func checkResponse(resp *http.Response, endpoint string) error {
+	recordRateLimit(resp)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	se := &StravaError{StatusCode: resp.StatusCode, Endpoint: endpoint}
+	if err := json.NewDecoder(resp.Body).Decode(se); err != nil || se.Message == "" {
+		se.Message = http.StatusText(resp.StatusCode)
+	}
+	return se
+}
@@ -0,0 +1,77 @@
+package strava
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	tests := map[string]struct {
+		status    int
+		body      string
+		result    *StravaError
+		permanent bool
+	}{
+		"ok": {
+			status: http.StatusOK,
+			body:   `{"id":1}`,
+		},
+		"not found": {
+			status: http.StatusNotFound,
+			body:   `{"message":"Record Not Found","errors":[{"resource":"Activity","field":"id","code":"invalid"}]}`,
+			result: &StravaError{
+				StatusCode: http.StatusNotFound,
+				Endpoint:   "GET /activities/{id}",
+				Message:    "Record Not Found",
+				Errors:     []ErrorDetail{{"Activity", "id", "invalid"}},
+			},
+			permanent: true,
+		},
+		"rate limited": {
+			status: http.StatusTooManyRequests,
+			body:   `{"message":"Rate Limit Exceeded","errors":[{"resource":"Application","field":"rate limit","code":"exceeded"}]}`,
+			result: &StravaError{
+				StatusCode: http.StatusTooManyRequests,
+				Endpoint:   "GET /activities/{id}",
+				Message:    "Rate Limit Exceeded",
+				Errors:     []ErrorDetail{{"Application", "rate limit", "exceeded"}},
+			},
+		},
+		"server error without body": {
+			status: http.StatusBadGateway,
+			body:   `<html>Bad Gateway</html>`,
+			result: &StravaError{
+				StatusCode: http.StatusBadGateway,
+				Endpoint:   "GET /activities/{id}",
+				Message:    "Bad Gateway",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status, Body: io.NopCloser(strings.NewReader(test.body))}
+			err := checkResponse(resp, "GET /activities/{id}")
+
+			if test.result == nil {
+				if err != nil {
+					t.Fatalf("checkResponse() got error %s, expected nil", err.Error())
+				}
+				return
+			}
+
+			se, ok := err.(*StravaError)
+			if !ok {
+				t.Fatalf("checkResponse() got error %v, expected StravaError", err)
+			}
+			if se.Error() != test.result.Error() {
+				t.Fatalf("checkResponse() got %s, expected %s", se.Error(), test.result.Error())
+			}
+			if got := IsPermanent(err); got != test.permanent {
+				t.Fatalf("IsPermanent() got %t, expected %t", got, test.permanent)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package strava
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	ShortLimit int
+	ShortUsage int
+	DailyLimit int
+	DailyUsage int
+	Time       time.Time
+}
+
+var (
+	rateLimitMu     sync.Mutex
+	latestRateLimit RateLimit
+)
+
+func parseRateLimitPair(header string) (int, int, bool) {
+	first, second, ok := strings.Cut(header, ",")
+	if !ok {
+		return 0, 0, false
+	}
+
+	a, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, false
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(second))
+	if err != nil {
+		return 0, 0, false
+	}
+	return a, b, true
+}
+
+func parseRateLimit(header http.Header, now time.Time) (RateLimit, bool) {
+	shortLimit, dailyLimit, ok := parseRateLimitPair(header.Get("X-RateLimit-Limit"))
+	if !ok {
+		return RateLimit{}, false
+	}
+	shortUsage, dailyUsage, ok := parseRateLimitPair(header.Get("X-RateLimit-Usage"))
+	if !ok {
+		return RateLimit{}, false
+	}
+	return RateLimit{shortLimit, shortUsage, dailyLimit, dailyUsage, now}, true
+}
+
+func recordRateLimit(resp *http.Response) {
+	rl, ok := parseRateLimit(resp.Header, time.Now())
+	if !ok {
+		return
+	}
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	if !rl.Time.Before(latestRateLimit.Time) {
+		latestRateLimit = rl
+	}
+}
+
+// LatestRateLimit returns the most recent rate limit reported by Strava to
+// this process, and false if no response has carried the headers yet.
+func LatestRateLimit() (RateLimit, bool) {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	return latestRateLimit, !latestRateLimit.Time.IsZero()
+}
@@ -0,0 +1,53 @@
+package strava
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := map[string]struct {
+		limit  string
+		usage  string
+		result RateLimit
+		ok     bool
+	}{
+		"valid": {
+			limit:  "200,2000",
+			usage:  "12,345",
+			result: RateLimit{200, 12, 2000, 345, now},
+			ok:     true,
+		},
+		"spaces": {
+			limit:  "100, 1000",
+			usage:  "0, 7",
+			result: RateLimit{100, 0, 1000, 7, now},
+			ok:     true,
+		},
+		"missing usage": {
+			limit: "200,2000",
+		},
+		"malformed": {
+			limit: "200",
+			usage: "12,abc",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("X-RateLimit-Limit", test.limit)
+			header.Set("X-RateLimit-Usage", test.usage)
+
+			rl, ok := parseRateLimit(header, now)
+			if ok != test.ok {
+				t.Fatalf("parseRateLimit() got ok %t, expected %t", ok, test.ok)
+			}
+			if rl != test.result {
+				t.Fatalf("parseRateLimit() got %+v, expected %+v", rl, test.result)
+			}
+		})
+	}
+}
@@ -3,16 +3,86 @@ package strava
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
+// Scope is requested whenever an athlete authorizes the app. profile:read_all
+// lets the worker read the athlete's measurement preference.
+const Scope = "read,activity:read_all,activity:write,profile:read_all"
+
+// RequiredScopes must all be granted. Other scopes, such as profile:read_all
+// for the athlete's measurement preference, are optional.
+var RequiredScopes = []string{"activity:read_all", "activity:write"}
+
+func HasRequiredScopes(scope string) bool {
+	granted := map[string]bool{}
+	for _, s := range strings.Split(scope, ",") {
+		granted[strings.TrimSpace(s)] = true
+	}
+
+	for _, s := range RequiredScopes {
+		if !granted[s] {
+			return false
+		}
+	}
+	return true
+}
+
+type TokenAthlete struct {
+	Id int
+}
+
 type TokenResponse struct {
 	Access_token  string
 	Expires_at    int
 	Refresh_token string
+	Athlete       TokenAthlete
+}
+
+func GetAuthorizeUrl(redirectUri, scope, state string) string {
+	q := url.Values{}
+	q.Add("client_id", os.Getenv("STRAVA_CLIENT_ID"))
+	q.Add("redirect_uri", redirectUri)
+	q.Add("response_type", "code")
+	q.Add("approval_prompt", "auto")
+	q.Add("scope", scope)
+	q.Add("state", state)
+	return "https://www.strava.com/oauth/authorize?" + q.Encode()
+}
+
+func ExchangeToken(client *http.Client, code string) (tr TokenResponse, err error) {
+	req, err := http.NewRequest("POST", "https://www.strava.com/api/v3/oauth/token?grant_type=authorization_code", nil)
+	if err != nil {
+		return tr, err
+	}
+
+	q := req.URL.Query()
+	q.Add("client_id", os.Getenv("STRAVA_CLIENT_ID"))
+	q.Add("client_secret", os.Getenv("STRAVA_CLIENT_SECRET"))
+	q.Add("code", code)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return tr, err
+	}
+
+	defer resp.Body.Close()
+
+	if err = checkResponse(resp, "POST /oauth/token"); err != nil {
+		return tr, err
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return tr, err
+	}
+
+	return tr, nil
 }
 
-func GetNewTokens(refreshToken string) (tr TokenResponse, err error) {
+func GetNewTokens(client *http.Client, refreshToken string) (tr TokenResponse, err error) {
 	req, err := http.NewRequest("POST", "https://www.strava.com/api/v3/oauth/token?grant_type=refresh_token", nil)
 	if err != nil {
 		return tr, err
@@ -24,13 +94,17 @@ func GetNewTokens(refreshToken string) (tr TokenResponse, err error) {
 	q.Add("refresh_token", refreshToken)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return tr, err
 	}
 
 	defer resp.Body.Close()
 
+	if err = checkResponse(resp, "POST /oauth/token"); err != nil {
+		return tr, err
+	}
+
 	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
 		return tr, err
 	}
@@ -0,0 +1,40 @@
+package strava
+
+import (
+	"testing"
+)
+
+func TestHasRequiredScopes(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		result bool
+	}{
+		"all scopes": {
+			input:  "read,activity:read,activity:read_all,activity:write",
+			result: true,
+		},
+		"with profile": {
+			input:  "read,activity:read_all,activity:write,profile:read_all",
+			result: true,
+		},
+		"missing write": {
+			input:  "read,activity:read,activity:read_all",
+			result: false,
+		},
+		"missing read all": {
+			input:  "read,activity:read,activity:write",
+			result: false,
+		},
+		"empty": {
+			input:  "",
+			result: false,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := HasRequiredScopes(test.input), test.result; got != expected {
+				t.Fatalf("HasRequiredScopes() got %t, expected %t", got, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package weather
+
+import (
+	"strings"
+)
+
+type Language string
+
+const (
+	English Language = "en"
+	Spanish Language = "es"
+	French  Language = "fr"
+	German  Language = "de"
+)
+
+var conditionNames = map[Language]map[string]string{
+	Spanish: {
+		"Thunderstorm":  "Tormenta",
+		"Drizzle":       "Llovizna",
+		"Rain":          "Lluvia",
+		"Snow":          "Nieve",
+		"Mist":          "Neblina",
+		"Smoke":         "Humo",
+		"Haze":          "Calima",
+		"Dust":          "Polvo",
+		"Fog":           "Niebla",
+		"Sand":          "Arena",
+		"Ash":           "Ceniza",
+		"Squall":        "Turbonada",
+		"Tornado":       "Tornado",
+		"Sunny":         "Soleado",
+		"Clear":         "Despejado",
+		"Mostly sunny":  "Mayormente soleado",
+		"Mostly clear":  "Mayormente despejado",
+		"Partly cloudy": "Parcialmente nublado",
+		"Mostly cloudy": "Mayormente nublado",
+		"Cloudy":        "Nublado",
+	},
+	French: {
+		"Thunderstorm":  "Orage",
+		"Drizzle":       "Bruine",
+		"Rain":          "Pluie",
+		"Snow":          "Neige",
+		"Mist":          "Brume",
+		"Smoke":         "Fumée",
+		"Haze":          "Brume sèche",
+		"Dust":          "Poussière",
+		"Fog":           "Brouillard",
+		"Sand":          "Sable",
+		"Ash":           "Cendres",
+		"Squall":        "Grain",
+		"Tornado":       "Tornade",
+		"Sunny":         "Ensoleillé",
+		"Clear":         "Dégagé",
+		"Mostly sunny":  "Plutôt ensoleillé",
+		"Mostly clear":  "Plutôt dégagé",
+		"Partly cloudy": "Partiellement nuageux",
+		"Mostly cloudy": "Plutôt nuageux",
+		"Cloudy":        "Nuageux",
+	},
+	German: {
+		"Thunderstorm":  "Gewitter",
+		"Drizzle":       "Nieselregen",
+		"Rain":          "Regen",
+		"Snow":          "Schnee",
+		"Mist":          "Dunst",
+		"Smoke":         "Rauch",
+		"Haze":          "Trockener Dunst",
+		"Dust":          "Staub",
+		"Fog":           "Nebel",
+		"Sand":          "Sand",
+		"Ash":           "Asche",
+		"Squall":        "Sturmböen",
+		"Tornado":       "Tornado",
+		"Sunny":         "Sonnig",
+		"Clear":         "Klar",
+		"Mostly sunny":  "Überwiegend sonnig",
+		"Mostly clear":  "Überwiegend klar",
+		"Partly cloudy": "Teilweise bewölkt",
+		"Mostly cloudy": "Überwiegend bewölkt",
+		"Cloudy":        "Bewölkt",
+	},
+}
+
+// Compass points use O for west in Spanish and French, and for east in German.
+var compassReplacers = map[Language]*strings.Replacer{
+	Spanish: strings.NewReplacer("W", "O"),
+	French:  strings.NewReplacer("W", "O"),
+	German:  strings.NewReplacer("E", "O"),
+}
+
+var defaultTemplates = map[Language]Template{
+	English: DefaultTemplate,
+	Spanish: MustParseTemplate("{{.emoji}} {{.condition}}, {{.temp}}, Sensación térmica {{.feels_like}}, Humedad {{.humidity}}, Viento {{.wind_speed}}" +
+		"{{if .wind_dir}} del {{.wind_dir}}{{if .wind_gust}}, rachas de {{.wind_gust}}{{end}}{{end}}" +
+		"{{if .precip}}, Precipitación {{.precip}}{{end}}"),
+	French: MustParseTemplate("{{.emoji}} {{.condition}}, {{.temp}}, Ressenti {{.feels_like}}, Humidité {{.humidity}}, Vent {{.wind_speed}}" +
+		"{{if .wind_dir}} de secteur {{.wind_dir}}{{if .wind_gust}}, rafales {{.wind_gust}}{{end}}{{end}}" +
+		"{{if .precip}}, Précipitations {{.precip}}{{end}}"),
+	German: MustParseTemplate("{{.emoji}} {{.condition}}, {{.temp}}, Gefühlt {{.feels_like}}, Luftfeuchtigkeit {{.humidity}}, Wind {{.wind_speed}}" +
+		"{{if .wind_dir}} aus {{.wind_dir}}{{if .wind_gust}}, Böen {{.wind_gust}}{{end}}{{end}}" +
+		"{{if .precip}}, Niederschlag {{.precip}}{{end}}"),
+}
+
+// ParseLanguage accepts an ISO 639-1 code. An empty string selects English.
+func ParseLanguage(s string) (Language, error) {
+	switch Language(strings.ToLower(s)) {
+	case "", English:
+		return English, nil
+	case Spanish:
+		return Spanish, nil
+	case French:
+		return French, nil
+	case German:
+		return German, nil
+	}
+	return "", &WeatherError{"Unknown language " + s}
+}
+
+func (l Language) translateCondition(name string) string {
+	if translated, ok := conditionNames[l][name]; ok {
+		return translated
+	}
+	return name
+}
+
+func (l Language) translateWindDirection(dir string) string {
+	if replacer, ok := compassReplacers[l]; ok {
+		return replacer.Replace(dir)
+	}
+	return dir
+}
+
+// GetDefaultTemplate returns the default template written in the language.
+func GetDefaultTemplate(language Language) Template {
+	if tmpl, ok := defaultTemplates[language]; ok {
+		return tmpl
+	}
+	return DefaultTemplate
+}
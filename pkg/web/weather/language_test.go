@@ -0,0 +1,82 @@
+package weather
+
+import (
+	"testing"
+)
+
+func TestParseLanguage(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		result    Language
+		resultErr string
+	}{
+		"empty": {
+			input:  "",
+			result: English,
+		},
+		"german": {
+			input:  "DE",
+			result: German,
+		},
+		"unknown": {
+			input:     "xx",
+			resultErr: "Unknown language xx",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			language, err := ParseLanguage(test.input)
+			if test.resultErr != "" {
+				if err == nil || err.Error() != test.resultErr {
+					t.Fatalf("ParseLanguage() got error %v, expected %s", err, test.resultErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLanguage() got error %s", err.Error())
+			}
+			if language != test.result {
+				t.Fatalf("ParseLanguage() got %s, expected %s", language, test.result)
+			}
+		})
+	}
+}
+
+func TestGetDefaultTemplate(t *testing.T) {
+	obs := Observation{Condition: PartlyCloudy, IsDay: true, Temp: 10.0, FeelsLike: 8.4, Humidity: 50, WindSpeed: 5.0, WindGust: 10.0, WindDeg: 270, Precipitation: 0.5}
+
+	tests := map[string]struct {
+		format Format
+		result string
+	}{
+		"english": {
+			format: Format{Units: Metric, Language: English},
+			result: "⛅ Partly cloudy, 10°C, Feels like 8°C, Humidity 50%, Wind 18km/h with 36km/h gusts from W, Precipitation 0.5 mm/hr",
+		},
+		"spanish": {
+			format: Format{Units: Metric, Language: Spanish},
+			result: "⛅ Parcialmente nublado, 10°C, Sensación térmica 8°C, Humedad 50%, Viento 18km/h del O, rachas de 36km/h, Precipitación 0.5 mm/hr",
+		},
+		"french": {
+			format: Format{Units: Metric, Language: French},
+			result: "⛅ Partiellement nuageux, 10°C, Ressenti 8°C, Humidité 50%, Vent 18km/h de secteur O, rafales 36km/h, Précipitations 0.5 mm/hr",
+		},
+		"german without emoji": {
+			format: Format{Units: Metric, Language: German, HideEmoji: true},
+			result: "Teilweise bewölkt, 10°C, Gefühlt 8°C, Luftfeuchtigkeit 50%, Wind 18km/h aus W, Böen 36km/h, Niederschlag 0.5 mm/hr",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			desc, err := GetDefaultTemplate(test.format.Language).Execute(obs, test.format)
+			if err != nil {
+				t.Fatalf("Execute() got error %s", err.Error())
+			}
+			if desc != test.result {
+				t.Fatalf("Execute() got %q, expected %q", desc, test.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package weather
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nwsUrl = "https://api.weather.gov"
+const nwsUserAgent = "strava-wx (https://github.com/dal-liu/strava-wx)"
+const nwsMaxStations = 3
+const nwsWindow = time.Hour
+
+type NationalWeatherService struct {
+	client  *http.Client
+	baseUrl string
+}
+
+type nwsProblem struct {
+	Detail string
+}
+
+type nwsPoint struct {
+	Properties struct {
+		ObservationStations string
+	}
+}
+
+type nwsStations struct {
+	Features []struct {
+		Properties struct {
+			StationIdentifier string
+		}
+	}
+}
+
+type nwsValue struct {
+	Value    *float64
+	UnitCode string
+}
+
+func (v nwsValue) isSet() bool {
+	return v.Value != nil
+}
+
+func (v nwsValue) get() float64 {
+	if v.Value == nil {
+		return 0
+	}
+
+	switch value := *v.Value; v.UnitCode {
+	case "wmoUnit:degF":
+		return (value - 32) * 5 / 9
+	case "wmoUnit:km_h-1":
+		return value / 3.6
+	case "wmoUnit:m":
+		return value * 1000
+	default:
+		return value
+	}
+}
+
+type nwsObservation struct {
+	Timestamp             string
+	Icon                  string
+	Temperature           nwsValue
+	HeatIndex             nwsValue
+	WindChill             nwsValue
+	RelativeHumidity      nwsValue
+	WindSpeed             nwsValue
+	WindGust              nwsValue
+	WindDirection         nwsValue
+	PrecipitationLastHour nwsValue
+}
+
+type nwsObservations struct {
+	Features []struct {
+		Properties nwsObservation
+	}
+}
+
+func getNwsCondition(icon string) (Condition, bool, error) {
+	u, err := url.Parse(icon)
+	if err != nil {
+		return UnknownCondition, false, err
+	}
+
+	// Icon paths look like /icons/land/day/rain,40/ovc; the first weather
+	// segment after the time of day is the predominant condition.
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 4 {
+		return UnknownCondition, false, &WeatherError{"No weather condition received"}
+	}
+	isDay := parts[2] == "day"
+	code, _, _ := strings.Cut(parts[3], ",")
+
+	switch code {
+	case "tsra", "tsra_sct", "tsra_hi":
+		return Thunderstorm, isDay, nil
+	case "rain", "rain_showers", "rain_showers_hi", "fzra", "rain_fzra", "rain_sleet", "sleet":
+		return Rain, isDay, nil
+	case "snow", "rain_snow", "snow_sleet", "snow_fzra", "blizzard":
+		return Snow, isDay, nil
+	case "fog":
+		return Fog, isDay, nil
+	case "smoke":
+		return Smoke, isDay, nil
+	case "haze":
+		return Haze, isDay, nil
+	case "dust":
+		return Dust, isDay, nil
+	case "tornado", "hurricane", "tropical_storm":
+		return Tornado, isDay, nil
+	case "skc", "wind_skc", "hot", "cold":
+		return Clear, isDay, nil
+	case "few", "wind_few":
+		return MostlyClear, isDay, nil
+	case "sct", "wind_sct":
+		return PartlyCloudy, isDay, nil
+	case "bkn", "wind_bkn":
+		return MostlyCloudy, isDay, nil
+	case "ovc", "wind_ovc":
+		return Cloudy, isDay, nil
+	}
+
+	return UnknownCondition, isDay, &WeatherError{"Unknown weather condition"}
+}
+
+func (o nwsObservation) toObservation() (Observation, error) {
+	t, err := time.Parse(time.RFC3339, o.Timestamp)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	cond, isDay, err := getNwsCondition(o.Icon)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	feelsLike := o.Temperature
+	if o.HeatIndex.isSet() {
+		feelsLike = o.HeatIndex
+	} else if o.WindChill.isSet() {
+		feelsLike = o.WindChill
+	}
+
+	return Observation{
+		Time:          t.UTC(),
+		IsDay:         isDay,
+		Condition:     cond,
+		Temp:          o.Temperature.get(),
+		FeelsLike:     feelsLike.get(),
+		Humidity:      int(math.Round(o.RelativeHumidity.get())),
+		WindSpeed:     o.WindSpeed.get(),
+		WindGust:      o.WindGust.get(),
+		WindDeg:       int(math.Round(o.WindDirection.get())),
+		Precipitation: o.PrecipitationLastHour.get(),
+	}, nil
+}
+
+func (obs nwsObservations) getClosest(dt time.Time) (nwsObservation, bool) {
+	var closest nwsObservation
+	var best time.Duration
+	found := false
+	for _, f := range obs.Features {
+		t, err := time.Parse(time.RFC3339, f.Properties.Timestamp)
+		if err != nil || !f.Properties.Temperature.isSet() {
+			continue
+		}
+
+		diff := t.Sub(dt)
+		if diff < 0 {
+			diff = -diff
+		}
+		if !found || diff < best {
+			closest = f.Properties
+			best = diff
+			found = true
+		}
+	}
+	return closest, found
+}
+
+func (p NationalWeatherService) Name() string {
+	return "National Weather Service"
+}
+
+func (p NationalWeatherService) get(rawUrl string, out any) error {
+	req, err := http.NewRequest("GET", rawUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", nwsUserAgent)
+	req.Header.Set("Accept", "application/geo+json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var problem nwsProblem
+		json.NewDecoder(resp.Body).Decode(&problem)
+		return &StatusError{p.Name(), resp.StatusCode, problem.Detail}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p NationalWeatherService) getStations(lat, lon float64) ([]string, error) {
+	var point nwsPoint
+	if err := p.get(p.baseUrl+"/points/"+strconv.FormatFloat(lat, 'f', 4, 64)+","+strconv.FormatFloat(lon, 'f', 4, 64), &point); err != nil {
+		return nil, err
+	}
+	if point.Properties.ObservationStations == "" {
+		return nil, &WeatherError{"No observation stations found"}
+	}
+
+	var stations nwsStations
+	if err := p.get(point.Properties.ObservationStations, &stations); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, f := range stations.Features {
+		if len(ids) == nwsMaxStations {
+			break
+		}
+		ids = append(ids, f.Properties.StationIdentifier)
+	}
+	if len(ids) == 0 {
+		return nil, &WeatherError{"No observation stations found"}
+	}
+	return ids, nil
+}
+
+func (p NationalWeatherService) GetObservation(lat, lon float64, dt time.Time) (Observation, error) {
+	stations, err := p.getStations(lat, lon)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	q := url.Values{}
+	q.Add("start", dt.Add(-nwsWindow).UTC().Format(time.RFC3339))
+	q.Add("end", dt.Add(nwsWindow).UTC().Format(time.RFC3339))
+
+	// Stations are ordered by distance, but the nearest one does not always
+	// report, so fall back to the next few.
+	for _, station := range stations {
+		var observations nwsObservations
+		if err := p.get(p.baseUrl+"/stations/"+url.PathEscape(station)+"/observations?"+q.Encode(), &observations); err != nil {
+			return Observation{}, err
+		}
+
+		if closest, ok := observations.getClosest(dt); ok {
+			return closest.toObservation()
+		}
+	}
+
+	return Observation{}, &WeatherError{"No weather data received"}
+}
+
+func CreateNationalWeatherService(client *http.Client) NationalWeatherService {
+	return NationalWeatherService{client, nwsUrl}
+}
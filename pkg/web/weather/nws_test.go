@@ -0,0 +1,203 @@
+package weather
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetNwsCondition(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		result    Condition
+		isDay     bool
+		resultErr string
+	}{
+		"sunny": {
+			input:  "https://api.weather.gov/icons/land/day/skc?size=medium",
+			result: Clear,
+			isDay:  true,
+		},
+		"partly cloudy night": {
+			input:  "https://api.weather.gov/icons/land/night/sct?size=medium",
+			result: PartlyCloudy,
+		},
+		"rain with probability": {
+			input:  "https://api.weather.gov/icons/land/day/rain,40/ovc?size=medium",
+			result: Rain,
+			isDay:  true,
+		},
+		"no weather condition received": {
+			input:     "",
+			resultErr: "No weather condition received",
+		},
+		"unknown weather condition": {
+			input:     "https://api.weather.gov/icons/land/day/volcano?size=medium",
+			isDay:     true,
+			resultErr: "Unknown weather condition",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cond, isDay, err := getNwsCondition(test.input)
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("getNwsCondition() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("getNwsCondition() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getNwsCondition() got error %s, expected %d", err.Error(), test.result)
+			}
+			if cond != test.result || isDay != test.isDay {
+				t.Fatalf("getNwsCondition() got %d, %t, expected %d, %t", cond, isDay, test.result, test.isDay)
+			}
+		})
+	}
+}
+
+func createNwsServer(t *testing.T, routes map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != nwsUserAgent {
+			t.Errorf("unexpected User-Agent %s", r.Header.Get("User-Agent"))
+		}
+
+		fixture, ok := routes[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		body, err := os.ReadFile(fixture)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if strings.HasSuffix(fixture, "not_found.json") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(strings.ReplaceAll(string(body), nwsUrl, server.URL)))
+	}))
+	return server
+}
+
+func TestGetClosest(t *testing.T) {
+	server := createNwsServer(t, map[string]string{"/observations": "testdata/nws_observations.json"})
+	defer server.Close()
+
+	var observations nwsObservations
+	if err := (NationalWeatherService{server.Client(), server.URL}).get(server.URL+"/observations", &observations); err != nil {
+		t.Fatal(err)
+	}
+	if len(observations.Features) != 3 {
+		t.Fatalf("got %d observations, expected 3", len(observations.Features))
+	}
+
+	tests := map[string]struct {
+		input  time.Time
+		result string
+	}{
+		"before": {
+			input:  time.Date(2023, 11, 14, 13, 30, 0, 0, time.UTC),
+			result: "2023-11-14T13:51:00+00:00",
+		},
+		"skips missing temperature": {
+			input:  time.Date(2023, 11, 14, 14, 10, 0, 0, time.UTC),
+			result: "2023-11-14T13:51:00+00:00",
+		},
+		"after": {
+			input:  time.Date(2023, 11, 14, 14, 40, 0, 0, time.UTC),
+			result: "2023-11-14T14:51:00+00:00",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			closest, ok := observations.getClosest(test.input)
+			if !ok {
+				t.Fatalf("getClosest() found no observation, expected %s", test.result)
+			}
+			if closest.Timestamp != test.result {
+				t.Fatalf("getClosest() got %s, expected %s", closest.Timestamp, test.result)
+			}
+		})
+	}
+}
+
+func TestNationalWeatherServiceGetObservation(t *testing.T) {
+	kmh := func(v float64) float64 { return v / 3.6 }
+	tests := map[string]struct {
+		routes    map[string]string
+		lat, lon  float64
+		result    Observation
+		resultErr string
+	}{
+		"falls back to next station": {
+			routes: map[string]string{
+				"/points/41.8781,-87.6298":       "testdata/nws_points.json",
+				"/gridpoints/LOT/76,73/stations": "testdata/nws_stations.json",
+				"/stations/KMDW/observations":    "testdata/nws_observations_empty.json",
+				"/stations/KORD/observations":    "testdata/nws_observations.json",
+			},
+			lat: 41.8781,
+			lon: -87.6298,
+			result: Observation{
+				Time:          time.Date(2023, 11, 14, 14, 51, 0, 0, time.UTC),
+				IsDay:         true,
+				Condition:     Rain,
+				Temp:          9.4,
+				FeelsLike:     6.8,
+				Humidity:      61,
+				WindSpeed:     kmh(18.36),
+				WindGust:      kmh(31.68),
+				WindDeg:       230,
+				Precipitation: 0.5,
+			},
+		},
+		"outside the United States": {
+			routes: map[string]string{
+				"/points/51.5074,-0.1278": "testdata/nws_not_found.json",
+			},
+			lat:       51.5074,
+			lon:       -0.1278,
+			resultErr: "National Weather Service returned status 404: Unable to provide data for requested point 51.5074,-0.1278",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := createNwsServer(t, test.routes)
+			defer server.Close()
+
+			provider := NationalWeatherService{server.Client(), server.URL}
+			obs, err := provider.GetObservation(test.lat, test.lon, time.Date(2023, 11, 14, 14, 40, 0, 0, time.UTC))
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("GetObservation() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("GetObservation() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("GetObservation() got error %s", err.Error())
+			}
+			if obs != test.result {
+				t.Fatalf("GetObservation() got %+v, expected %+v", obs, test.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package weather
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const openMeteoForecastUrl = "https://api.open-meteo.com/v1/forecast"
+const openMeteoArchiveUrl = "https://archive-api.open-meteo.com/v1/archive"
+const openMeteoTimeLayout = "2006-01-02T15:04"
+const openMeteoHourlyFields = "temperature_2m,apparent_temperature,relative_humidity_2m,precipitation,weather_code,wind_speed_10m,wind_direction_10m,wind_gusts_10m,is_day"
+
+// The archive lags real time by several days, so recent activities are
+// looked up through the forecast API's past data instead.
+const openMeteoArchiveDelay = 5 * 24 * time.Hour
+
+type OpenMeteo struct {
+	client      *http.Client
+	forecastUrl string
+	archiveUrl  string
+}
+
+type openMeteoHourly struct {
+	Time                 []string
+	Temperature_2m       []*float64
+	Apparent_temperature []*float64
+	Relative_humidity_2m []*float64
+	Precipitation        []*float64
+	Weather_code         []*int
+	Wind_speed_10m       []*float64
+	Wind_direction_10m   []*float64
+	Wind_gusts_10m       []*float64
+	Is_day               []int
+}
+
+type openMeteoError struct {
+	Reason string
+}
+
+type openMeteoResponse struct {
+	Hourly openMeteoHourly
+}
+
+func getWmoCondition(code int) (Condition, error) {
+	switch code {
+	case 0:
+		return Clear, nil
+	case 1:
+		return MostlyClear, nil
+	case 2:
+		return PartlyCloudy, nil
+	case 3:
+		return Cloudy, nil
+	case 45, 48:
+		return Fog, nil
+	case 51, 53, 55, 56, 57:
+		return Drizzle, nil
+	case 61, 63, 65, 66, 67, 80, 81, 82:
+		return Rain, nil
+	case 71, 73, 75, 77, 85, 86:
+		return Snow, nil
+	case 95, 96, 99:
+		return Thunderstorm, nil
+	}
+
+	return UnknownCondition, &WeatherError{"Unknown weather condition"}
+}
+
+func (h openMeteoHourly) getIndex(dt time.Time) (int, error) {
+	index := -1
+	var best time.Duration
+	for i, s := range h.Time {
+		t, err := time.Parse(openMeteoTimeLayout, s)
+		if err != nil {
+			return -1, err
+		}
+
+		diff := t.Sub(dt)
+		if diff < 0 {
+			diff = -diff
+		}
+		if index == -1 || diff < best {
+			index = i
+			best = diff
+		}
+	}
+
+	if index == -1 {
+		return -1, &WeatherError{"No weather data received"}
+	}
+	return index, nil
+}
+
+func getHourlyValue[T any](values []T, i int) T {
+	var zero T
+	if i >= len(values) {
+		return zero
+	}
+	return values[i]
+}
+
+// getOptionalValue returns 0 for a missing value, which the description
+// treats the same as no gusts or no precipitation.
+func getOptionalValue(values []*float64, i int) float64 {
+	v := getHourlyValue(values, i)
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func (r openMeteoResponse) toObservation(dt time.Time) (Observation, error) {
+	h := r.Hourly
+	i, err := h.getIndex(dt)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	code := getHourlyValue(h.Weather_code, i)
+	if code == nil {
+		return Observation{}, &WeatherError{"No weather condition received"}
+	}
+	cond, err := getWmoCondition(*code)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	// Open-Meteo reports null for hours it has no data for. The fields that
+	// always appear in the description are required; feels like falls back to
+	// the temperature, and missing gusts or precipitation are left out.
+	temp := getHourlyValue(h.Temperature_2m, i)
+	humidity := getHourlyValue(h.Relative_humidity_2m, i)
+	windSpeed := getHourlyValue(h.Wind_speed_10m, i)
+	windDeg := getHourlyValue(h.Wind_direction_10m, i)
+	if temp == nil || humidity == nil || windSpeed == nil || windDeg == nil {
+		return Observation{}, &WeatherError{"No weather data received"}
+	}
+
+	feelsLike := getHourlyValue(h.Apparent_temperature, i)
+	if feelsLike == nil {
+		feelsLike = temp
+	}
+
+	t, _ := time.Parse(openMeteoTimeLayout, h.Time[i])
+	return Observation{
+		Time:          t,
+		IsDay:         getHourlyValue(h.Is_day, i) == 1,
+		Condition:     cond,
+		Temp:          *temp,
+		FeelsLike:     *feelsLike,
+		Humidity:      int(math.Round(*humidity)),
+		WindSpeed:     *windSpeed,
+		WindGust:      getOptionalValue(h.Wind_gusts_10m, i),
+		WindDeg:       int(math.Round(*windDeg)),
+		Precipitation: getOptionalValue(h.Precipitation, i),
+	}, nil
+}
+
+func (p OpenMeteo) Name() string {
+	return "Open-Meteo"
+}
+
+func (p OpenMeteo) GetObservation(lat, lon float64, dt time.Time) (Observation, error) {
+	dt = dt.UTC()
+	url := p.archiveUrl
+	if time.Since(dt) < openMeteoArchiveDelay {
+		url = p.forecastUrl
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	date := dt.Format(time.DateOnly)
+	q := req.URL.Query()
+	q.Add("latitude", strconv.FormatFloat(lat, 'f', -1, 64))
+	q.Add("longitude", strconv.FormatFloat(lon, 'f', -1, 64))
+	q.Add("start_date", date)
+	q.Add("end_date", date)
+	q.Add("hourly", openMeteoHourlyFields)
+	q.Add("wind_speed_unit", "ms")
+	q.Add("timezone", "GMT")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e openMeteoError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return Observation{}, &StatusError{p.Name(), resp.StatusCode, e.Reason}
+	}
+
+	var r openMeteoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return Observation{}, err
+	}
+
+	return r.toObservation(dt)
+}
+
+func CreateOpenMeteo(client *http.Client) OpenMeteo {
+	return OpenMeteo{client, openMeteoForecastUrl, openMeteoArchiveUrl}
+}
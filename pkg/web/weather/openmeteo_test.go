@@ -0,0 +1,199 @@
+package weather
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetWmoCondition(t *testing.T) {
+	tests := map[string]struct {
+		input     int
+		result    Condition
+		resultErr string
+	}{
+		"clear": {
+			input:  0,
+			result: Clear,
+		},
+		"overcast": {
+			input:  3,
+			result: Cloudy,
+		},
+		"freezing drizzle": {
+			input:  57,
+			result: Drizzle,
+		},
+		"rain showers": {
+			input:  81,
+			result: Rain,
+		},
+		"snow grains": {
+			input:  77,
+			result: Snow,
+		},
+		"thunderstorm with hail": {
+			input:  99,
+			result: Thunderstorm,
+		},
+		"unknown weather condition": {
+			input:     4,
+			resultErr: "Unknown weather condition",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cond, err := getWmoCondition(test.input)
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("getWmoCondition() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("getWmoCondition() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getWmoCondition() got error %s, expected %d", err.Error(), test.result)
+			}
+			if cond != test.result {
+				t.Fatalf("getWmoCondition() got %d, expected %d", cond, test.result)
+			}
+		})
+	}
+}
+
+func createOpenMeteoServer(t *testing.T, fixture string, paths *[]string) *httptest.Server {
+	body, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*paths = append(*paths, r.URL.Path)
+		q := r.URL.Query()
+		if q.Get("wind_speed_unit") != "ms" || q.Get("timezone") != "GMT" || q.Get("start_date") != q.Get("end_date") {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		if strings.HasSuffix(fixture, "error.json") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write(body)
+	}))
+}
+
+func TestOpenMeteoGetObservation(t *testing.T) {
+	tests := map[string]struct {
+		fixture   string
+		input     time.Time
+		result    Observation
+		resultErr string
+	}{
+		"nearest hour": {
+			fixture: "testdata/openmeteo.json",
+			input:   time.Date(2023, 11, 14, 14, 20, 0, 0, time.UTC),
+			result: Observation{
+				Time:          time.Date(2023, 11, 14, 14, 0, 0, 0, time.UTC),
+				IsDay:         true,
+				Condition:     Rain,
+				Temp:          9.6,
+				FeelsLike:     7.0,
+				Humidity:      59,
+				WindSpeed:     4.7,
+				WindGust:      8.5,
+				WindDeg:       229,
+				Precipitation: 0.4,
+			},
+		},
+		"night": {
+			fixture: "testdata/openmeteo.json",
+			input:   time.Date(2023, 11, 14, 1, 45, 0, 0, time.UTC),
+			result: Observation{
+				Time:      time.Date(2023, 11, 14, 2, 0, 0, 0, time.UTC),
+				IsDay:     false,
+				Condition: MostlyClear,
+				Temp:      3.5,
+				FeelsLike: 0.9,
+				Humidity:  90,
+				WindSpeed: 1.9,
+				WindGust:  3.4,
+				WindDeg:   210,
+			},
+		},
+		"missing optional values": {
+			fixture: "testdata/openmeteo_nulls.json",
+			input:   time.Date(2023, 11, 14, 14, 20, 0, 0, time.UTC),
+			result: Observation{
+				Time:      time.Date(2023, 11, 14, 14, 0, 0, 0, time.UTC),
+				IsDay:     true,
+				Condition: Cloudy,
+				Temp:      9.6,
+				FeelsLike: 9.6,
+				Humidity:  59,
+				WindSpeed: 4.7,
+				WindDeg:   229,
+			},
+		},
+		"missing temperature": {
+			fixture:   "testdata/openmeteo_nulls.json",
+			input:     time.Date(2023, 11, 14, 15, 10, 0, 0, time.UTC),
+			resultErr: "No weather data received",
+		},
+		"error": {
+			fixture:   "testdata/openmeteo_error.json",
+			input:     time.Date(2023, 11, 14, 14, 20, 0, 0, time.UTC),
+			resultErr: "Open-Meteo returned status 400: Parameter 'start_date' is out of allowed range from 1940-01-01 to 2023-11-20",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var paths []string
+			server := createOpenMeteoServer(t, test.fixture, &paths)
+			defer server.Close()
+
+			provider := OpenMeteo{server.Client(), server.URL + "/forecast", server.URL + "/archive"}
+			obs, err := provider.GetObservation(41.87, -87.62, test.input)
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("GetObservation() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("GetObservation() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("GetObservation() got error %s", err.Error())
+			}
+			if len(paths) != 1 || paths[0] != "/archive" {
+				t.Fatalf("GetObservation() requested %v, expected [/archive]", paths)
+			}
+			if obs != test.result {
+				t.Fatalf("GetObservation() got %+v, expected %+v", obs, test.result)
+			}
+		})
+	}
+}
+
+func TestOpenMeteoRecentActivity(t *testing.T) {
+	var paths []string
+	server := createOpenMeteoServer(t, "testdata/openmeteo.json", &paths)
+	defer server.Close()
+
+	provider := OpenMeteo{server.Client(), server.URL + "/forecast", server.URL + "/archive"}
+	if _, err := provider.GetObservation(41.87, -87.62, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("GetObservation() got error %s", err.Error())
+	}
+	if len(paths) != 1 || paths[0] != "/forecast" {
+		t.Fatalf("GetObservation() requested %v, expected [/forecast]", paths)
+	}
+}
@@ -0,0 +1,171 @@
+package weather
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const openWeatherMapUrl = "https://api.openweathermap.org/data/3.0/onecall/timemachine?units=metric"
+
+type OpenWeatherMap struct {
+	client  *http.Client
+	apiKey  string
+	baseUrl string
+}
+
+type openWeatherMapError struct {
+	Message string
+}
+
+type weatherCondition struct {
+	Id int
+}
+
+type weatherPrecipitation struct {
+	One_hour float64 `json:"1h"`
+}
+
+type weatherData struct {
+	Dt         int
+	Sunrise    int
+	Sunset     int
+	Temp       float64
+	Feels_like float64
+	Humidity   int
+	Wind_speed float64
+	Wind_deg   int
+	Wind_gust  float64
+	Weather    []weatherCondition
+	Rain       weatherPrecipitation
+	Snow       weatherPrecipitation
+}
+
+func (wd weatherData) isDay() bool {
+	return wd.Dt >= wd.Sunrise && wd.Dt < wd.Sunset
+}
+
+func (wd weatherData) getCondition() (Condition, error) {
+	if len(wd.Weather) == 0 {
+		return UnknownCondition, &WeatherError{"No weather condition received"}
+	}
+
+	switch wd.Weather[0].Id {
+	case 200, 201, 202, 210, 211, 212, 221, 230, 231, 232:
+		return Thunderstorm, nil
+	case 300, 301, 302, 310, 311, 312, 313, 314, 321:
+		return Drizzle, nil
+	case 500, 501, 502, 503, 504, 511, 520, 521, 522, 531:
+		return Rain, nil
+	case 600, 601, 602, 611, 612, 613, 615, 616, 620, 621, 622:
+		return Snow, nil
+	case 701:
+		return Mist, nil
+	case 711:
+		return Smoke, nil
+	case 721:
+		return Haze, nil
+	case 731, 761:
+		return Dust, nil
+	case 741:
+		return Fog, nil
+	case 751:
+		return Sand, nil
+	case 762:
+		return Ash, nil
+	case 771:
+		return Squall, nil
+	case 781:
+		return Tornado, nil
+	case 800:
+		return Clear, nil
+	case 801:
+		return MostlyClear, nil
+	case 802:
+		return PartlyCloudy, nil
+	case 803:
+		return MostlyCloudy, nil
+	case 804:
+		return Cloudy, nil
+	}
+
+	return UnknownCondition, &WeatherError{"Unknown weather condition"}
+}
+
+func (wd weatherData) getPrecipitation() float64 {
+	return wd.Rain.One_hour + wd.Snow.One_hour
+}
+
+func (wd weatherData) toObservation() (Observation, error) {
+	cond, err := wd.getCondition()
+	if err != nil {
+		return Observation{}, err
+	}
+
+	return Observation{
+		Time:          time.Unix(int64(wd.Dt), 0).UTC(),
+		IsDay:         wd.isDay(),
+		Condition:     cond,
+		Temp:          wd.Temp,
+		FeelsLike:     wd.Feels_like,
+		Humidity:      wd.Humidity,
+		WindSpeed:     wd.Wind_speed,
+		WindGust:      wd.Wind_gust,
+		WindDeg:       wd.Wind_deg,
+		Precipitation: wd.getPrecipitation(),
+	}, nil
+}
+
+type weatherResponse struct {
+	Data []weatherData
+}
+
+func (wr weatherResponse) toObservation() (Observation, error) {
+	if len(wr.Data) == 0 {
+		return Observation{}, &WeatherError{"No weather data received"}
+	}
+	return wr.Data[0].toObservation()
+}
+
+func (p OpenWeatherMap) Name() string {
+	return "OpenWeatherMap"
+}
+
+func (p OpenWeatherMap) GetObservation(lat, lon float64, dt time.Time) (Observation, error) {
+	req, err := http.NewRequest("GET", p.baseUrl, nil)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	q := req.URL.Query()
+	q.Add("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	q.Add("lon", strconv.FormatFloat(lon, 'f', -1, 64))
+	q.Add("dt", strconv.FormatInt(dt.Unix(), 10))
+	q.Add("appid", p.apiKey)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e openWeatherMapError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return Observation{}, &StatusError{p.Name(), resp.StatusCode, e.Message}
+	}
+
+	var wr weatherResponse
+	if err := json.NewDecoder(resp.Body).Decode(&wr); err != nil {
+		return Observation{}, err
+	}
+
+	return wr.toObservation()
+}
+
+func CreateOpenWeatherMap(client *http.Client, apiKey string) OpenWeatherMap {
+	return OpenWeatherMap{client, apiKey, openWeatherMapUrl}
+}
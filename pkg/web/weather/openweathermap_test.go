@@ -0,0 +1,149 @@
+package weather
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsDay(t *testing.T) {
+	tests := map[string]struct {
+		input  weatherData
+		result bool
+	}{
+		"day": {
+			input:  weatherData{Dt: 2, Sunrise: 1, Sunset: 3},
+			result: true,
+		},
+		"night": {
+			input:  weatherData{Dt: 4, Sunrise: 1, Sunset: 3},
+			result: false,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := test.input.isDay(), test.result; got != expected {
+				t.Fatalf("isDay() got %t, expected %t", got, expected)
+			}
+		})
+	}
+}
+
+func TestGetOpenWeatherMapCondition(t *testing.T) {
+	tests := map[string]struct {
+		input     weatherData
+		result    Condition
+		resultErr string
+	}{
+		"no weather condition received": {
+			input:     weatherData{},
+			resultErr: "No weather condition received",
+		},
+		"unknown weather condition": {
+			input:     weatherData{Weather: []weatherCondition{{0}}},
+			resultErr: "Unknown weather condition",
+		},
+		"cloudy": {
+			input:  weatherData{Weather: []weatherCondition{{804}}},
+			result: Cloudy,
+		},
+		"clear": {
+			input:  weatherData{Weather: []weatherCondition{{800}}},
+			result: Clear,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cond, err := test.input.getCondition()
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("getCondition() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("getCondition() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getCondition() got error %s, expected %d", err.Error(), test.result)
+			}
+			if cond != test.result {
+				t.Fatalf("getCondition() got %d, expected %d", cond, test.result)
+			}
+		})
+	}
+}
+
+func TestGetPrecipitation(t *testing.T) {
+	tests := map[string]struct {
+		input  weatherData
+		result float64
+	}{
+		"0.0": {
+			input:  weatherData{},
+			result: 0.0,
+		},
+		"25.4": {
+			input:  weatherData{Rain: weatherPrecipitation{12.7}, Snow: weatherPrecipitation{12.7}},
+			result: 25.4,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := test.input.getPrecipitation(), test.result; math.Abs(got-expected) >= epsilon {
+				t.Fatalf("getPrecipitation() got %f, expected %f", got, expected)
+			}
+		})
+	}
+}
+
+func TestOpenWeatherMapGetObservation(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/openweathermap.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var query map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = map[string]string{}
+		for k := range r.URL.Query() {
+			query[k] = r.URL.Query().Get(k)
+		}
+		w.Write(fixture)
+	}))
+	defer server.Close()
+
+	provider := OpenWeatherMap{server.Client(), "key", server.URL + "?units=metric"}
+	obs, err := provider.GetObservation(41.8781, -87.6298, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("GetObservation() got error %s", err.Error())
+	}
+
+	for k, v := range map[string]string{"lat": "41.8781", "lon": "-87.6298", "dt": "1700000000", "appid": "key", "units": "metric"} {
+		if query[k] != v {
+			t.Fatalf("GetObservation() sent %s=%s, expected %s", k, query[k], v)
+		}
+	}
+
+	expected := Observation{
+		Time:          time.Unix(1700000000, 0).UTC(),
+		IsDay:         true,
+		Condition:     Rain,
+		Temp:          8.2,
+		FeelsLike:     5.9,
+		Humidity:      62,
+		WindSpeed:     4.12,
+		WindGust:      7.2,
+		WindDeg:       230,
+		Precipitation: 0.42,
+	}
+	if obs != expected {
+		t.Fatalf("GetObservation() got %+v, expected %+v", obs, expected)
+	}
+}
@@ -0,0 +1,205 @@
+package weather
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+)
+
+const defaultTemplate = "{{.emoji}} {{.condition}}, {{.temp}}, Feels like {{.feels_like}}, Humidity {{.humidity}}, Wind {{.wind_speed}}" +
+	"{{if .wind_dir}} {{if .wind_gust}}with {{.wind_gust}} gusts {{end}}from {{.wind_dir}}{{end}}" +
+	"{{if .precip}}, Precipitation {{.precip}}{{end}}"
+
+var templateFields = []string{
+	"condition",
+	"emoji",
+	"temp",
+	"feels_like",
+	"humidity",
+	"wind_speed",
+	"wind_gust",
+	"wind_dir",
+	"precip",
+	"provider",
+}
+
+// MaxDescriptionLength caps the rendered weather in characters, so that it
+// fits in a Strava description alongside the athlete's own text.
+const MaxDescriptionLength = 1000
+
+var DefaultTemplate = MustParseTemplate(defaultTemplate)
+
+type Template struct {
+	tmpl *template.Template
+}
+
+func ParseTemplate(text string) (Template, error) {
+	tmpl, err := template.New("description").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return Template{}, &WeatherError{"Invalid template: " + err.Error()}
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if err := checkTemplateNode(t.Tree.Root); err != nil {
+			return Template{}, err
+		}
+	}
+
+	return Template{tmpl}, nil
+}
+
+func MustParseTemplate(text string) Template {
+	t, err := ParseTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func checkTemplateField(ident []string) error {
+	name := strings.Join(ident, ".")
+	if len(ident) != 1 {
+		return &WeatherError{"Unknown template field " + name}
+	}
+	for _, field := range templateFields {
+		if field == name {
+			return nil
+		}
+	}
+	return &WeatherError{"Unknown template field " + name}
+}
+
+// checkTemplateNode walks the parse tree and rejects any field that the
+// description data does not provide, so typos fail when the template is saved
+// rather than when an activity is processed. Only text, fields and if are
+// allowed, so a template cannot loop or call functions.
+func checkTemplateNode(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplateNode(child); err != nil {
+				return err
+			}
+		}
+	case *parse.TextNode, *parse.CommentNode:
+		return nil
+	case *parse.ActionNode:
+		return checkTemplatePipe(n.Pipe)
+	case *parse.IfNode:
+		if err := checkTemplatePipe(n.Pipe); err != nil {
+			return err
+		}
+		if err := checkTemplateNode(n.List); err != nil {
+			return err
+		}
+		return checkTemplateNode(n.ElseList)
+	default:
+		return &WeatherError{"Unsupported template action " + node.String()}
+	}
+	return nil
+}
+
+// checkTemplatePipe accepts a pipeline made of a single field, such as
+// {{.temp}} or {{$.temp}}.
+func checkTemplatePipe(pipe *parse.PipeNode) error {
+	if len(pipe.Decl) != 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return &WeatherError{"Unsupported template action " + pipe.String()}
+	}
+
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		return checkTemplateField(arg.Ident)
+	case *parse.VariableNode:
+		if len(arg.Ident) > 1 && arg.Ident[0] == "$" {
+			return checkTemplateField(arg.Ident[1:])
+		}
+	}
+	return &WeatherError{"Unsupported template action " + pipe.String()}
+}
+
+// Format controls how the fields of a description are written.
+type Format struct {
+	Units     Units
+	Language  Language
+	HideEmoji bool
+}
+
+func (o Observation) getFields(format Format) (map[string]string, error) {
+	emoji, cond, err := o.getCondition()
+	if err != nil {
+		return nil, err
+	}
+	if format.HideEmoji {
+		emoji = ""
+	}
+
+	units := format.Units
+	fields := map[string]string{
+		"condition":  format.Language.translateCondition(cond),
+		"emoji":      emoji,
+		"temp":       units.formatTemp(o.Temp),
+		"feels_like": units.formatTemp(o.FeelsLike),
+		"humidity":   strconv.Itoa(o.Humidity) + "%",
+		"wind_speed": units.formatSpeed(0),
+		"wind_gust":  "",
+		"wind_dir":   "",
+		"precip":     "",
+		"provider":   o.Provider,
+	}
+
+	if o.WindSpeed >= calmWindSpeed {
+		fields["wind_speed"] = units.formatSpeed(o.WindSpeed)
+		fields["wind_dir"] = format.Language.translateWindDirection(o.getWindDirection())
+		if o.WindGust >= calmWindSpeed {
+			fields["wind_gust"] = units.formatSpeed(o.WindGust)
+		}
+	}
+
+	if o.Precipitation >= minPrecipitation {
+		fields["precip"] = units.formatPrecip(o.Precipitation)
+	}
+
+	return fields, nil
+}
+
+func (t Template) Execute(o Observation, format Format) (string, error) {
+	fields, err := o.getFields(format)
+	if err != nil {
+		return "", err
+	}
+
+	w := limitedWriter{limit: MaxDescriptionLength}
+	if err := t.tmpl.Execute(&w, fields); err != nil {
+		var we *WeatherError
+		if errors.As(err, &we) {
+			return "", we
+		}
+		return "", &WeatherError{"Invalid template: " + err.Error()}
+	}
+	return strings.TrimSpace(w.sb.String()), nil
+}
+
+// limitedWriter fails once more than limit characters are written, which
+// stops the template from executing further.
+type limitedWriter struct {
+	sb    strings.Builder
+	limit int
+	count int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.count += utf8.RuneCount(p)
+	if w.count > w.limit {
+		return 0, &WeatherError{"Description is longer than " + strconv.Itoa(w.limit) + " characters"}
+	}
+	return w.sb.Write(p)
+}
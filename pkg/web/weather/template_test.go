@@ -0,0 +1,146 @@
+package weather
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		resultErr string
+	}{
+		"default": {
+			input: defaultTemplate,
+		},
+		"root variable": {
+			input: "{{$.emoji}} {{if $.precip}}{{$.precip}}{{end}}",
+		},
+		"range": {
+			input:     "{{range $i := 1000000000}}{{$.temp}}{{end}}",
+			resultErr: "Unsupported template action {{range $i := 1000000000}}{{$.temp}}{{end}}",
+		},
+		"with": {
+			input:     "{{with .precip}}{{.}}{{end}}",
+			resultErr: "Unsupported template action {{with .precip}}{{.}}{{end}}",
+		},
+		"template": {
+			input:     `{{define "loop"}}{{template "loop"}}{{end}}{{template "loop"}}`,
+			resultErr: `Unsupported template action {{template "loop"}}`,
+		},
+		"function": {
+			input:     `{{printf "%0999999d" 1}}`,
+			resultErr: `Unsupported template action printf "%0999999d" 1`,
+		},
+		"pipeline": {
+			input:     `{{.temp | printf "%s"}}`,
+			resultErr: `Unsupported template action .temp | printf "%s"`,
+		},
+		"variable": {
+			input:     "{{$t := .temp}}{{$t}}",
+			resultErr: "Unsupported template action $t := .temp",
+		},
+		"literal": {
+			input:     `{{"hi"}}`,
+			resultErr: `Unsupported template action "hi"`,
+		},
+		"unknown field": {
+			input:     "{{.emoji}} {{.temperature}}",
+			resultErr: "Unknown template field temperature",
+		},
+		"unknown field in branch": {
+			input:     "{{if .precip}}{{.rain}}{{else}}{{.snow}}{{end}}",
+			resultErr: "Unknown template field rain",
+		},
+		"nested field": {
+			input:     "{{.temp.value}}",
+			resultErr: "Unknown template field temp.value",
+		},
+		"unknown root variable": {
+			input:     "{{$.dew_point}}",
+			resultErr: "Unknown template field dew_point",
+		},
+		"syntax error": {
+			input:     "{{.temp",
+			resultErr: "Invalid template: template: description:1: unclosed action",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseTemplate(test.input)
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("ParseTemplate() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("ParseTemplate() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseTemplate() got error %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestExecute(t *testing.T) {
+	obs := Observation{Provider: "Open-Meteo", Condition: Rain, Temp: 10.0, FeelsLike: 8.4, Humidity: 50, WindSpeed: 6.7056, WindDeg: 180, Precipitation: 0.5}
+
+	tests := map[string]struct {
+		input  string
+		units  Units
+		result string
+	}{
+		"compact": {
+			input:  "{{.emoji}} {{.temp}} ({{.feels_like}}) {{.wind_dir}} {{.wind_speed}}",
+			units:  Metric,
+			result: "🌧️ 10°C (8°C) S 24km/h",
+		},
+		"multiline": {
+			input:  "{{.condition}}\n💧 {{.humidity}}{{if .precip}} · {{.precip}}{{end}}\nData: {{.provider}}",
+			units:  Imperial,
+			result: "Rain\n💧 50% · 0.02 in/hr\nData: Open-Meteo",
+		},
+		"missing gust": {
+			input:  "{{.wind_speed}}{{if .wind_gust}} gusting {{.wind_gust}}{{end}}",
+			units:  UK,
+			result: "15mph",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(test.input)
+			if err != nil {
+				t.Fatalf("ParseTemplate() got error %s", err.Error())
+			}
+
+			desc, err := tmpl.Execute(obs, Format{Units: test.units})
+			if err != nil {
+				t.Fatalf("Execute() got error %s", err.Error())
+			}
+			if desc != test.result {
+				t.Fatalf("Execute() got %q, expected %q", desc, test.result)
+			}
+		})
+	}
+}
+
+func TestExecuteTooLong(t *testing.T) {
+	obs := Observation{Condition: Clear, Temp: 10.0, FeelsLike: 10.0, Humidity: 50}
+
+	tmpl := MustParseTemplate(strings.Repeat("{{.temp}} ", MaxDescriptionLength/5))
+	if _, err := tmpl.Execute(obs, Format{Units: Metric}); err != nil {
+		t.Fatalf("Execute() got error %s", err.Error())
+	}
+
+	tmpl = MustParseTemplate(strings.Repeat("{{.temp}} ", MaxDescriptionLength/5+1))
+	_, err := tmpl.Execute(obs, Format{Units: Metric})
+	if err == nil || err.Error() != "Description is longer than 1000 characters" {
+		t.Fatalf("Execute() got error %v, expected Description is longer than 1000 characters", err)
+	}
+}
@@ -1,9 +1,11 @@
 package weather
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +13,14 @@ import (
 
 const epsilon float64 = 0.005
 const mmPerInch float64 = 25.4
+const mphPerMps float64 = 2.2369362920544
+const kmhPerMps float64 = 3.6
+
+// Thresholds are applied to the raw metric values so every unit system agrees
+// on whether there is wind or precipitation. Calm is force 0 on the Beaufort
+// scale; the precipitation cutoff is the smallest amount shown in in/hr.
+const calmWindSpeed float64 = 0.5
+const minPrecipitation float64 = epsilon * mmPerInch
 
 type WeatherError struct {
 	message string
@@ -20,100 +30,244 @@ func (e *WeatherError) Error() string {
 	return e.message
 }
 
-type weatherCondition struct {
-	Id int
-}
-
-type weatherPrecipitation struct {
-	One_hour float64 `json:"1h"`
-}
-
-type weatherData struct {
-	Dt         int
-	Sunrise    int
-	Sunset     int
-	Temp       float64
-	Feels_like float64
-	Humidity   int
-	Wind_speed float64
-	Wind_deg   int
-	Wind_gust  float64
-	Weather    []weatherCondition
-	Rain       weatherPrecipitation
-	Snow       weatherPrecipitation
-}
-
-func (wd weatherData) isDay() bool {
-	return wd.Dt >= wd.Sunrise && wd.Dt < wd.Sunset
-}
-
-func (wd weatherData) getCondition() (string, error) {
-	if len(wd.Weather) == 0 {
-		return "", &WeatherError{"No weather condition received"}
-	}
-
-	switch wd.Weather[0].Id {
-	case 200, 201, 202, 210, 211, 212, 221, 230, 231, 232:
-		return "🌩️ Thunderstorm", nil
-	case 300, 301, 302, 310, 311, 312, 313, 314, 321:
-		return "🌧️ Drizzle", nil
-	case 500, 501, 502, 503, 504, 511, 520, 521, 522, 531:
-		return "🌧️ Rain", nil
-	case 600, 601, 602, 611, 612, 613, 615, 616, 620, 621, 622:
-		return "🌨️ Snow", nil
-	case 701:
-		return "🌫️ Mist", nil
-	case 711:
-		return "🌫️ Smoke", nil
-	case 721:
-		return "🌫️ Haze", nil
-	case 731:
-		return "🌫️ Dust", nil
-	case 741:
-		return "🌫️ Fog", nil
-	case 751:
-		return "🌫️ Sand", nil
-	case 761:
-		return "🌫️ Dust", nil
-	case 762:
-		return "🌫️ Ash", nil
-	case 771:
-		return "🌫️ Squall", nil
-	case 781:
-		return "🌪️ Tornado", nil
-	case 800:
-		if wd.isDay() {
-			return "☀️ Sunny", nil
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("%s returned status %d", e.Provider, e.StatusCode)
+	}
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.StatusCode, e.message)
+}
+
+type ChainError struct {
+	errs []error
+}
+
+func (e *ChainError) Error() string {
+	messages := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		messages[i] = err.Error()
+	}
+	return "All weather providers failed: " + strings.Join(messages, "; ")
+}
+
+func (e *ChainError) Unwrap() []error {
+	return e.errs
+}
+
+// IsPermanent reports whether err comes from a weather provider and cannot be
+// fixed by retrying later. Timeouts, 5xx and 429 responses are retriable.
+func IsPermanent(err error) bool {
+	var ce *ChainError
+	if errors.As(err, &ce) {
+		for _, e := range ce.errs {
+			if !IsPermanent(e) {
+				return false
+			}
+		}
+		return len(ce.errs) > 0
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode != http.StatusTooManyRequests && se.StatusCode < http.StatusInternalServerError
+	}
+
+	var we *WeatherError
+	return errors.As(err, &we)
+}
+
+type Units string
+
+const (
+	Imperial  Units = "imperial"
+	Metric    Units = "metric"
+	MetricMps Units = "metric_ms"
+	UK        Units = "uk"
+)
+
+func ParseUnits(s string) (Units, error) {
+	switch u := Units(strings.ToLower(s)); u {
+	case Imperial, Metric, MetricMps, UK:
+		return u, nil
+	}
+	return "", &WeatherError{"Unknown units " + s}
+}
+
+// GetDefaultUnits returns the units in WEATHER_UNITS, or imperial if unset.
+// They are used when the athlete has not chosen units and Strava does not
+// report a measurement preference.
+func GetDefaultUnits() (Units, error) {
+	if units := os.Getenv("WEATHER_UNITS"); units != "" {
+		return ParseUnits(units)
+	}
+	return Imperial, nil
+}
+
+func (u Units) formatTemp(c float64) string {
+	if u == Imperial {
+		return strconv.FormatFloat(math.Round(c*9/5+32), 'f', -1, 64) + "°F"
+	}
+	return strconv.FormatFloat(math.Round(c), 'f', -1, 64) + "°C"
+}
+
+func (u Units) formatSpeed(mps float64) string {
+	switch u {
+	case Metric:
+		return strconv.FormatFloat(math.Round(mps*kmhPerMps), 'f', -1, 64) + "km/h"
+	case MetricMps:
+		return strconv.FormatFloat(math.Round(mps), 'f', -1, 64) + "m/s"
+	}
+	return strconv.FormatFloat(math.Round(mps*mphPerMps), 'f', -1, 64) + "mph"
+}
+
+func (u Units) formatPrecip(mm float64) string {
+	if u == Imperial {
+		return strconv.FormatFloat(mm/mmPerInch, 'f', 2, 64) + " in/hr"
+	}
+	return strconv.FormatFloat(mm, 'f', 1, 64) + " mm/hr"
+}
+
+type Condition int
+
+const (
+	UnknownCondition Condition = iota
+	Thunderstorm
+	Drizzle
+	Rain
+	Snow
+	Mist
+	Smoke
+	Haze
+	Dust
+	Fog
+	Sand
+	Ash
+	Squall
+	Tornado
+	Clear
+	MostlyClear
+	PartlyCloudy
+	MostlyCloudy
+	Cloudy
+)
+
+// Observation holds provider-neutral weather data in metric units.
+type Observation struct {
+	Provider      string
+	Time          time.Time
+	IsDay         bool
+	Condition     Condition
+	Temp          float64 // °C
+	FeelsLike     float64 // °C
+	Humidity      int     // %
+	WindSpeed     float64 // m/s
+	WindGust      float64 // m/s
+	WindDeg       int
+	Precipitation float64 // mm/hr
+}
+
+type WeatherProvider interface {
+	Name() string
+	GetObservation(lat, lon float64, dt time.Time) (Observation, error)
+}
+
+type Chain struct {
+	providers []WeatherProvider
+}
+
+func (c Chain) Name() string {
+	names := make([]string, len(c.providers))
+	for i, p := range c.providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+func (c Chain) GetObservation(lat, lon float64, dt time.Time) (Observation, error) {
+	var errs []error
+	for _, p := range c.providers {
+		obs, err := p.GetObservation(lat, lon, dt)
+		if err == nil {
+			if obs.Provider == "" {
+				obs.Provider = p.Name()
+			}
+			return obs, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	return Observation{}, &ChainError{errs}
+}
+
+func CreateChain(providers ...WeatherProvider) Chain {
+	return Chain{providers}
+}
+
+func (o Observation) getCondition() (string, string, error) {
+	switch o.Condition {
+	case Thunderstorm:
+		return "🌩️", "Thunderstorm", nil
+	case Drizzle:
+		return "🌧️", "Drizzle", nil
+	case Rain:
+		return "🌧️", "Rain", nil
+	case Snow:
+		return "🌨️", "Snow", nil
+	case Mist:
+		return "🌫️", "Mist", nil
+	case Smoke:
+		return "🌫️", "Smoke", nil
+	case Haze:
+		return "🌫️", "Haze", nil
+	case Dust:
+		return "🌫️", "Dust", nil
+	case Fog:
+		return "🌫️", "Fog", nil
+	case Sand:
+		return "🌫️", "Sand", nil
+	case Ash:
+		return "🌫️", "Ash", nil
+	case Squall:
+		return "🌫️", "Squall", nil
+	case Tornado:
+		return "🌪️", "Tornado", nil
+	case Clear:
+		if o.IsDay {
+			return "☀️", "Sunny", nil
 		} else {
-			return "🌙 Clear", nil
+			return "🌙", "Clear", nil
 		}
-	case 801:
-		if wd.isDay() {
-			return "🌤️ Mostly sunny", nil
+	case MostlyClear:
+		if o.IsDay {
+			return "🌤️", "Mostly sunny", nil
 		} else {
-			return "🌙 Mostly clear", nil
+			return "🌙", "Mostly clear", nil
 		}
-	case 802:
-		if wd.isDay() {
-			return "⛅ Partly cloudy", nil
+	case PartlyCloudy:
+		if o.IsDay {
+			return "⛅", "Partly cloudy", nil
 		} else {
-			return "☁️ Partly cloudy", nil
+			return "☁️", "Partly cloudy", nil
 		}
-	case 803:
-		if wd.isDay() {
-			return "🌥️ Mostly cloudy", nil
+	case MostlyCloudy:
+		if o.IsDay {
+			return "🌥️", "Mostly cloudy", nil
 		} else {
-			return "☁️ Mostly cloudy", nil
+			return "☁️", "Mostly cloudy", nil
 		}
-	case 804:
-		return "☁️ Cloudy", nil
+	case Cloudy:
+		return "☁️", "Cloudy", nil
 	}
 
-	return "", &WeatherError{"Unknown weather condition"}
+	return "", "", &WeatherError{"Unknown weather condition"}
 }
 
-func (wd weatherData) getWindDirection() string {
-	deg := float64(wd.Wind_deg)
+func (o Observation) getWindDirection() string {
+	deg := float64(o.WindDeg)
 	switch {
 	case deg >= 348.75 || deg < 11.25:
 		return "N"
@@ -151,95 +305,68 @@ func (wd weatherData) getWindDirection() string {
 	return "?"
 }
 
-func (wd weatherData) getPrecipitation() float64 {
-	return (wd.Rain.One_hour + wd.Snow.One_hour) / mmPerInch
+func (o Observation) getDescription(units Units) (string, error) {
+	return DefaultTemplate.Execute(o, Format{Units: units})
 }
 
-type weatherResponse struct {
-	Data []weatherData
-}
-
-func (wr weatherResponse) getDescription() (string, error) {
-	if len(wr.Data) == 0 {
-		return "", &WeatherError{"No weather data received"}
+func createProvider(client *http.Client, name string) (WeatherProvider, error) {
+	switch name {
+	case "openweathermap":
+		return CreateOpenWeatherMap(client, os.Getenv("WEATHER_API_KEY")), nil
+	case "openmeteo":
+		return CreateOpenMeteo(client), nil
+	case "nws":
+		return CreateNationalWeatherService(client), nil
 	}
-	data := wr.Data[0]
-
-	var sb strings.Builder
+	return nil, &WeatherError{"Unknown weather provider " + name}
+}
 
-	cond, err := data.getCondition()
-	if err != nil {
-		return "", err
+func CreateProvider(client *http.Client) (WeatherProvider, error) {
+	names := os.Getenv("WEATHER_PROVIDER")
+	if names == "" {
+		names = "openweathermap"
 	}
-	sb.WriteString(cond)
-	sb.WriteString(", ")
-
-	sb.WriteString(strconv.FormatFloat(math.Round(data.Temp), 'f', -1, 64))
-	sb.WriteString("°F, ")
-
-	sb.WriteString("Feels like ")
-	sb.WriteString(strconv.FormatFloat(math.Round(data.Feels_like), 'f', -1, 64))
-	sb.WriteString("°F, ")
-
-	sb.WriteString("Humidity ")
-	sb.WriteString(strconv.Itoa(data.Humidity))
-	sb.WriteString("%, ")
-
-	sb.WriteString("Wind ")
-	if windSpeed := math.Round(data.Wind_speed); windSpeed == 0 {
-		sb.WriteString("0mph")
-	} else {
-		sb.WriteString(strconv.FormatFloat(windSpeed, 'f', -1, 64))
-		sb.WriteString("mph ")
 
-		if windGust := math.Round(data.Wind_gust); windGust > 0 {
-			sb.WriteString("with ")
-			sb.WriteString(strconv.FormatFloat(windGust, 'f', -1, 64))
-			sb.WriteString("mph gusts ")
+	var providers []WeatherProvider
+	for _, name := range strings.Split(names, ",") {
+		provider, err := createProvider(client, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
 		}
-
-		sb.WriteString("from ")
-		sb.WriteString(data.getWindDirection())
+		providers = append(providers, provider)
 	}
 
-	if precip := data.getPrecipitation(); precip >= epsilon {
-		sb.WriteString(", Precipitation ")
-		sb.WriteString(strconv.FormatFloat(precip, 'f', 2, 64))
-		sb.WriteString(" in/hr")
+	if len(providers) == 1 {
+		return providers[0], nil
 	}
-
-	return sb.String(), nil
+	return CreateChain(providers...), nil
 }
 
-func GetWeatherDescription(client *http.Client, apiKey string, lat, lon float64, date string) (string, error) {
+func GetObservation(provider WeatherProvider, lat, lon float64, date string) (Observation, error) {
 	dt, err := time.Parse(time.RFC3339, date)
 	if err != nil {
-		return "", err
+		return Observation{}, err
 	}
 
-	req, err := http.NewRequest("GET", "https://api.openweathermap.org/data/3.0/onecall/timemachine?units=imperial", nil)
+	obs, err := provider.GetObservation(lat, lon, dt)
 	if err != nil {
-		return "", err
+		return Observation{}, err
 	}
 
-	q := req.URL.Query()
-	q.Add("lat", strconv.FormatFloat(lat, 'f', -1, 64))
-	q.Add("lon", strconv.FormatFloat(lon, 'f', -1, 64))
-	q.Add("dt", strconv.FormatInt(dt.Unix(), 10))
-	q.Add("appid", apiKey)
-	req.URL.RawQuery = q.Encode()
+	if obs.Provider == "" {
+		obs.Provider = provider.Name()
+	}
+	return obs, nil
+}
 
-	resp, err := client.Do(req)
+func GetWeatherDescription(obs Observation, format Format, tmpl Template, credit bool) (string, error) {
+	description, err := tmpl.Execute(obs, format)
 	if err != nil {
 		return "", err
 	}
 
-	defer resp.Body.Close()
-
-	var wr weatherResponse
-	if err := json.NewDecoder(resp.Body).Decode(&wr); err != nil {
-		return "", err
+	if credit && obs.Provider != "" {
+		description += ", via " + obs.Provider
 	}
-
-	return wr.getDescription()
+	return description, nil
 }
@@ -1,64 +1,58 @@
 package weather
 
 import (
-	"math"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 )
 
-func TestIsDay(t *testing.T) {
-	tests := map[string]struct {
-		input  weatherData
-		result bool
-	}{
-		"day": {
-			input:  weatherData{Dt: 2, Sunrise: 1, Sunset: 3},
-			result: true,
-		},
-		"night": {
-			input:  weatherData{Dt: 4, Sunrise: 1, Sunset: 3},
-			result: false,
-		},
-	}
-	for name, test := range tests {
-		t.Run(name, func(t *testing.T) {
-			if got, expected := test.input.isDay(), test.result; got != expected {
-				t.Fatalf("isDay() got %t, expected %t", got, expected)
-			}
-		})
-	}
+type fakeProvider struct {
+	name  string
+	obs   Observation
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeProvider) GetObservation(lat, lon float64, dt time.Time) (Observation, error) {
+	p.calls++
+	return p.obs, p.err
 }
 
 func TestGetCondition(t *testing.T) {
 	tests := map[string]struct {
-		input     weatherData
+		input     Observation
 		result    string
 		resultErr string
 	}{
-		"no weather condition received": {
-			input:     weatherData{},
-			resultErr: "No weather condition received",
-		},
 		"unknown weather condition": {
-			input:     weatherData{Weather: []weatherCondition{{0}}},
+			input:     Observation{},
 			resultErr: "Unknown weather condition",
 		},
 		"cloudy": {
-			input:  weatherData{Weather: []weatherCondition{{804}}},
+			input:  Observation{Condition: Cloudy},
 			result: "☁️ Cloudy",
 		},
 		"sunny": {
-			input:  weatherData{Dt: 2, Sunrise: 1, Sunset: 3, Weather: []weatherCondition{{800}}},
+			input:  Observation{IsDay: true, Condition: Clear},
 			result: "☀️ Sunny",
 		},
 		"clear": {
-			input:  weatherData{Dt: 4, Sunrise: 1, Sunset: 3, Weather: []weatherCondition{{800}}},
+			input:  Observation{IsDay: false, Condition: Clear},
 			result: "🌙 Clear",
 		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			cond, err := test.input.getCondition()
+			emoji, name, err := test.input.getCondition()
+			cond := emoji + " " + name
 
 			if test.resultErr != "" {
 				if err == nil {
@@ -82,19 +76,19 @@ func TestGetCondition(t *testing.T) {
 
 func TestGetWindDirection(t *testing.T) {
 	tests := map[string]struct {
-		input  weatherData
+		input  Observation
 		result string
 	}{
 		"0": {
-			input:  weatherData{Wind_deg: 0},
+			input:  Observation{WindDeg: 0},
 			result: "N",
 		},
 		"360": {
-			input:  weatherData{Wind_deg: 360},
+			input:  Observation{WindDeg: 360},
 			result: "N",
 		},
 		"310": {
-			input:  weatherData{Wind_deg: 310},
+			input:  Observation{WindDeg: 310},
 			result: "NW",
 		},
 	}
@@ -107,76 +101,305 @@ func TestGetWindDirection(t *testing.T) {
 	}
 }
 
-func TestGetPrecipitation(t *testing.T) {
+func TestGetDescription(t *testing.T) {
 	tests := map[string]struct {
-		input  weatherData
-		result float64
+		input     Observation
+		units     Units
+		result    string
+		resultErr string
 	}{
-		"0.0": {
-			input:  weatherData{},
-			result: 0.0,
+		"unknown weather condition": {
+			input:     Observation{},
+			units:     Imperial,
+			resultErr: "Unknown weather condition",
+		},
+		"rain": {
+			input:  Observation{Condition: Rain, Temp: 10.0, FeelsLike: 10.0, Humidity: 50, WindSpeed: 6.7056, WindDeg: 180, WindGust: 6.7056, Precipitation: 0.5},
+			units:  Imperial,
+			result: "🌧️ Rain, 50°F, Feels like 50°F, Humidity 50%, Wind 15mph with 15mph gusts from S, Precipitation 0.02 in/hr",
+		},
+		"rounding": {
+			input:  Observation{Condition: PartlyCloudy, Temp: 19.9, FeelsLike: 21.3, Humidity: 80, WindSpeed: 2.0, WindDeg: 0},
+			units:  Imperial,
+			result: "☁️ Partly cloudy, 68°F, Feels like 70°F, Humidity 80%, Wind 4mph from N",
+		},
+		"no wind": {
+			input:  Observation{Condition: Snow, Temp: 0.0, FeelsLike: -6.7, Humidity: 41, WindSpeed: 0.0, Precipitation: 1.6},
+			units:  Imperial,
+			result: "🌨️ Snow, 32°F, Feels like 20°F, Humidity 41%, Wind 0mph, Precipitation 0.06 in/hr",
+		},
+		"metric": {
+			input:  Observation{Condition: Rain, Temp: 10.0, FeelsLike: 8.4, Humidity: 50, WindSpeed: 6.7056, WindDeg: 180, WindGust: 10.0, Precipitation: 0.5},
+			units:  Metric,
+			result: "🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 24km/h with 36km/h gusts from S, Precipitation 0.5 mm/hr",
+		},
+		"metric m/s": {
+			input:  Observation{Condition: Rain, Temp: 10.0, FeelsLike: 8.4, Humidity: 50, WindSpeed: 6.7056, WindDeg: 180, WindGust: 10.0, Precipitation: 0.5},
+			units:  MetricMps,
+			result: "🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 7m/s with 10m/s gusts from S, Precipitation 0.5 mm/hr",
+		},
+		"uk": {
+			input:  Observation{Condition: Rain, Temp: 10.0, FeelsLike: 8.4, Humidity: 50, WindSpeed: 6.7056, WindDeg: 180, WindGust: 10.0, Precipitation: 0.5},
+			units:  UK,
+			result: "🌧️ Rain, 10°C, Feels like 8°C, Humidity 50%, Wind 15mph with 22mph gusts from S, Precipitation 0.5 mm/hr",
+		},
+		"calm in every unit": {
+			input:  Observation{Condition: Cloudy, Temp: 10.0, FeelsLike: 10.0, Humidity: 50, WindSpeed: 0.45, WindGust: 0.45, Precipitation: 0.1},
+			units:  MetricMps,
+			result: "☁️ Cloudy, 10°C, Feels like 10°C, Humidity 50%, Wind 0m/s",
 		},
-		"1.0": {
-			input:  weatherData{Rain: weatherPrecipitation{12.7}, Snow: weatherPrecipitation{12.7}},
-			result: 1.0,
+		"light wind in every unit": {
+			input:  Observation{Condition: Cloudy, Temp: 10.0, FeelsLike: 10.0, Humidity: 50, WindSpeed: 0.5, WindDeg: 90, Precipitation: 0.2},
+			units:  MetricMps,
+			result: "☁️ Cloudy, 10°C, Feels like 10°C, Humidity 50%, Wind 1m/s from E, Precipitation 0.2 mm/hr",
 		},
 	}
+
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			if got, expected := test.input.getPrecipitation(), test.result; math.Abs(got-expected) >= epsilon {
-				t.Fatalf("getPrecipitation() got %f, expected %f", got, expected)
+			desc, err := test.input.getDescription(test.units)
+
+			if test.resultErr != "" {
+				if err == nil {
+					t.Fatalf("getDescription() got nil error, expected %s", test.resultErr)
+				}
+				if err.Error() != test.resultErr {
+					t.Fatalf("getDescription() got error %s, expected %s", err.Error(), test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getDescription() got error %s, expected %s", err.Error(), test.result)
+			}
+			if desc != test.result {
+				t.Fatalf("getDescription() got %s, expected %s", desc, test.result)
 			}
 		})
 	}
 }
 
-func TestGetDescription(t *testing.T) {
+func TestIsPermanent(t *testing.T) {
 	tests := map[string]struct {
-		input     weatherResponse
+		input  error
+		result bool
+	}{
+		"unknown weather condition": {
+			input:  &WeatherError{"Unknown weather condition"},
+			result: true,
+		},
+		"wrapped weather error": {
+			input:  fmt.Errorf("Open-Meteo: %w", &WeatherError{"No weather data received"}),
+			result: true,
+		},
+		"not found": {
+			input:  &StatusError{"National Weather Service", http.StatusNotFound, ""},
+			result: true,
+		},
+		"too many requests": {
+			input:  &StatusError{"OpenWeatherMap", http.StatusTooManyRequests, ""},
+			result: false,
+		},
+		"server error": {
+			input:  &StatusError{"Open-Meteo", http.StatusBadGateway, ""},
+			result: false,
+		},
+		"timeout": {
+			input:  context.DeadlineExceeded,
+			result: false,
+		},
+		"all permanent": {
+			input:  &ChainError{[]error{&WeatherError{"Unknown weather condition"}, &StatusError{"Open-Meteo", http.StatusBadRequest, ""}}},
+			result: true,
+		},
+		"one retriable": {
+			input:  &ChainError{[]error{&WeatherError{"Unknown weather condition"}, &StatusError{"Open-Meteo", http.StatusServiceUnavailable, ""}}},
+			result: false,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got, expected := IsPermanent(test.input), test.result; got != expected {
+				t.Fatalf("IsPermanent() got %t, expected %t", got, expected)
+			}
+		})
+	}
+}
+
+func TestChainGetObservation(t *testing.T) {
+	unavailable := &StatusError{"OpenWeatherMap", http.StatusServiceUnavailable, ""}
+	unknown := &WeatherError{"Unknown weather condition"}
+
+	tests := map[string]struct {
+		providers []*fakeProvider
 		result    string
-		resultErr string
+		calls     []int
+		permanent bool
 	}{
-		"no weather data": {
-			input:     weatherResponse{},
-			resultErr: "No weather data received",
+		"first succeeds": {
+			providers: []*fakeProvider{{name: "a", obs: Observation{Condition: Clear}}, {name: "b"}},
+			result:    "a",
+			calls:     []int{1, 0},
 		},
-		"no weather condition received": {
-			input:     weatherResponse{[]weatherData{{}}},
-			resultErr: "No weather condition received",
+		"falls back": {
+			providers: []*fakeProvider{{name: "a", err: unavailable}, {name: "b", err: unknown}, {name: "c", obs: Observation{Condition: Rain}}},
+			result:    "c",
+			calls:     []int{1, 1, 1},
 		},
-		"rain": {
-			input:  weatherResponse{[]weatherData{{Temp: 50.0, Feels_like: 50.0, Humidity: 50, Wind_speed: 15.0, Wind_deg: 180, Wind_gust: 15.0, Weather: []weatherCondition{{500}}, Rain: weatherPrecipitation{0.5}}}},
-			result: "🌧️ Rain, 50°F, Feels like 50°F, Humidity 50%, Wind 15mph with 15mph gusts from S, Precipitation 0.02 in/hr",
+		"all retriable": {
+			providers: []*fakeProvider{{name: "a", err: unavailable}, {name: "b", err: unknown}},
+			calls:     []int{1, 1},
+			permanent: false,
 		},
-		"rounding": {
-			input:  weatherResponse{[]weatherData{{Temp: 67.8, Feels_like: 70.4, Humidity: 80, Wind_speed: 4.5, Wind_deg: 0, Weather: []weatherCondition{{802}}}}},
-			result: "☁️ Partly cloudy, 68°F, Feels like 70°F, Humidity 80%, Wind 5mph from N",
+		"all permanent": {
+			providers: []*fakeProvider{{name: "a", err: unknown}, {name: "b", err: unknown}},
+			calls:     []int{1, 1},
+			permanent: true,
 		},
-		"no wind": {
-			input:  weatherResponse{[]weatherData{{Temp: 32.0, Feels_like: 20.0, Humidity: 41, Wind_speed: 0.0, Weather: []weatherCondition{{600}}, Snow: weatherPrecipitation{1.6}}}},
-			result: "🌨️ Snow, 32°F, Feels like 20°F, Humidity 41%, Wind 0mph, Precipitation 0.06 in/hr",
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var providers []WeatherProvider
+			for _, p := range test.providers {
+				providers = append(providers, p)
+			}
+
+			obs, err := CreateChain(providers...).GetObservation(0, 0, time.Time{})
+			for i, p := range test.providers {
+				if p.calls != test.calls[i] {
+					t.Fatalf("provider %s called %d times, expected %d", p.name, p.calls, test.calls[i])
+				}
+			}
+
+			if test.result == "" {
+				var ce *ChainError
+				if !errors.As(err, &ce) {
+					t.Fatalf("GetObservation() got error %v, expected ChainError", err)
+				}
+				if got := IsPermanent(err); got != test.permanent {
+					t.Fatalf("IsPermanent() got %t, expected %t", got, test.permanent)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("GetObservation() got error %s", err.Error())
+			}
+			if obs.Provider != test.result {
+				t.Fatalf("GetObservation() got provider %s, expected %s", obs.Provider, test.result)
+			}
+		})
+	}
+}
+
+func TestGetWeatherDescription(t *testing.T) {
+	obs := Observation{Provider: "Open-Meteo", Condition: Cloudy, Temp: 10.0, FeelsLike: 10.0, Humidity: 50}
+
+	tests := map[string]struct {
+		credit bool
+		result string
+	}{
+		"without credit": {
+			credit: false,
+			result: "☁️ Cloudy, 50°F, Feels like 50°F, Humidity 50%, Wind 0mph",
+		},
+		"with credit": {
+			credit: true,
+			result: "☁️ Cloudy, 50°F, Feels like 50°F, Humidity 50%, Wind 0mph, via Open-Meteo",
 		},
 	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			desc, err := GetWeatherDescription(obs, Format{Units: Imperial}, DefaultTemplate, test.credit)
+			if err != nil {
+				t.Fatalf("GetWeatherDescription() got error %s", err.Error())
+			}
+			if desc != test.result {
+				t.Fatalf("GetWeatherDescription() got %s, expected %s", desc, test.result)
+			}
+		})
+	}
+}
 
+func TestParseUnits(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		result    Units
+		resultErr string
+	}{
+		"imperial": {
+			input:  "imperial",
+			result: Imperial,
+		},
+		"case insensitive": {
+			input:  "UK",
+			result: UK,
+		},
+		"unknown": {
+			input:     "kelvin",
+			resultErr: "Unknown units kelvin",
+		},
+	}
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			desc, err := test.input.getDescription()
+			units, err := ParseUnits(test.input)
 
 			if test.resultErr != "" {
 				if err == nil {
-					t.Fatalf("getDescription() got nil error, expected %s", test.resultErr)
+					t.Fatalf("ParseUnits() got nil error, expected %s", test.resultErr)
 				}
 				if err.Error() != test.resultErr {
-					t.Fatalf("getDescription() got error %s, expected %s", err.Error(), test.resultErr)
+					t.Fatalf("ParseUnits() got error %s, expected %s", err.Error(), test.resultErr)
 				}
 				return
 			}
 
 			if err != nil {
-				t.Fatalf("getDescription() got error %s, expected %s", err.Error(), test.result)
+				t.Fatalf("ParseUnits() got error %s", err.Error())
 			}
-			if desc != test.result {
-				t.Fatalf("getDescription() got %s, expected %s", desc, test.result)
+			if units != test.result {
+				t.Fatalf("ParseUnits() got %s, expected %s", units, test.result)
+			}
+		})
+	}
+}
+
+func TestGetDefaultUnits(t *testing.T) {
+	tests := map[string]struct {
+		env       string
+		result    Units
+		resultErr string
+	}{
+		"unset": {
+			result: Imperial,
+		},
+		"set": {
+			env:    "metric",
+			result: Metric,
+		},
+		"unknown": {
+			env:       "kelvin",
+			resultErr: "Unknown units kelvin",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("WEATHER_UNITS", test.env)
+			units, err := GetDefaultUnits()
+
+			if test.resultErr != "" {
+				if err == nil || err.Error() != test.resultErr {
+					t.Fatalf("GetDefaultUnits() got error %v, expected %s", err, test.resultErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("GetDefaultUnits() got error %s", err.Error())
+			}
+			if units != test.result {
+				t.Fatalf("GetDefaultUnits() got %s, expected %s", units, test.result)
 			}
 		})
 	}